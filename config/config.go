@@ -1,8 +1,14 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"gopkg.in/yaml.v2"
 
@@ -10,37 +16,297 @@ import (
 )
 
 //Config holds information from a configuration file.
-type config struct {
+type Config struct {
 	//APIKey is the Riot Games API Key that tracks your apps API calls
 	APIKey string
 	//The applicable regions for requests to be made in
 	Regions []string
 	Rates   []types.Rate
+	//Rates for each method of the API, keyed by method name, which apply on
+	// top of Rates to requests for that method.
+	Methods map[string][]types.Rate
+	//The most requests to each region which may be waiting on the API at
+	// once, keyed by region, on top of Rates. Regions left out have no cap.
+	MaxInFlight map[string]int
+	//How requests are sent to the API
+	HTTP HTTP
+	//How requests which fail are sent again
+	Retry Retry
+	//Where responses are kept to save repeating requests
+	Cache Cache
 }
 
-var conf config
+// HTTP configures how requests are sent to the Riot API, such as through a
+// proxy or to a fake of the API. Settings left as their zero value keep the
+// default behaviour.
+type HTTP struct {
+	//The base URL of the API, in which %s is replaced by the name of the
+	// region being requested. Defaults to "https://%s.api.pvp.net".
+	BaseURL string
+	//URL of a proxy to send requests through. When empty, the HTTP_PROXY and
+	// HTTPS_PROXY environment variables are used.
+	Proxy string
+	//Bounds each request, from connecting until the response has been read,
+	// e.g. "10s". Zero for no limit.
+	Timeout time.Duration
+	//Bounds connecting to the API or the proxy. Zero for the default.
+	DialTimeout time.Duration
+	//Sent as the User-Agent header of each request. Go's default when empty.
+	UserAgent string
+}
 
-func LoadConfig(path string) error {
+//nil until a configuration has been loaded
+var conf *Config
+
+//Guards conf, which may be reloaded while it is being read
+var confLock sync.RWMutex
+
+// Load reads the YAML file at path into a new Config, without making it the
+// current configuration.
+func Load(path string) (*Config, error) {
 	f, err := os.Open(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer f.Close()
 	buf, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	ret := &Config{}
+	if err = yaml.Unmarshal(buf, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// LoadConfig replaces the current configuration with that of the YAML file at
+// path. The configuration is left as it was if the file can't be loaded.
+func LoadConfig(path string) error {
+	loaded, err := Load(path)
 	if err != nil {
 		return err
 	}
-	err = yaml.Unmarshal(buf, &conf)
-	return err
+	Use(loaded)
+	return nil
+}
+
+// Use makes cfg the current configuration, such as one loaded by a Watcher.
+// cfg must not be modified afterwards.
+func Use(cfg *Config) {
+	confLock.Lock()
+	conf = cfg
+	confLock.Unlock()
+}
+
+// Current returns the current configuration, or nil if none has been loaded.
+// The Config returned must not be modified.
+func Current() *Config {
+	confLock.RLock()
+	defer confLock.RUnlock()
+	return conf
+}
+
+// current returns the current configuration, or an empty one if none has been
+// loaded.
+func current() *Config {
+	if c := Current(); c != nil {
+		return c
+	}
+	return &Config{}
 }
 
 func ApiKey() string {
-	return conf.APIKey
+	return current().APIKey
 }
 
 func Regions() []string {
-	return conf.Regions
+	return current().Regions
 }
 
 func Rates() []types.Rate {
-	return conf.Rates
+	return current().Rates
+}
+
+func Methods() map[string][]types.Rate {
+	return current().Methods
+}
+
+func MaxInFlight() map[string]int {
+	return current().MaxInFlight
+}
+
+// KnownRegions are the regions for which the Riot API has an endpoint.
+var KnownRegions = []string{"br", "eune", "euw", "jp", "kr", "lan", "las", "na", "oce", "pbe", "ru", "tr"}
+
+// Validate checks that the configuration names at least one region, that every
+// region is one of KnownRegions and is named only once, that no set of rates
+// has more than one rate with the same period, that the most requests in
+// flight are only given for configured regions and aren't negative, and that
+// the HTTP, retry and cache settings are usable. Errs with every problem
+// found.
+func (c *Config) Validate() error {
+	var problems []string
+	if len(c.Regions) == 0 {
+		problems = append(problems, "no regions are configured")
+	}
+	seen := make(map[string]bool, len(c.Regions))
+	for _, region := range c.Regions {
+		switch {
+		case seen[region]:
+			problems = append(problems, fmt.Sprintf("region '%s' is configured more than once", region))
+		case !isKnownRegion(region):
+			problems = append(problems, fmt.Sprintf("unknown region '%s'", region))
+		}
+		seen[region] = true
+	}
+	if period, ok := duplicatePeriod(c.Rates); ok {
+		problems = append(problems, fmt.Sprintf("more than one rate with a period of %d", period))
+	}
+	for method, rates := range c.Methods {
+		if period, ok := duplicatePeriod(rates); ok {
+			problems = append(problems, fmt.Sprintf("more than one rate for method '%s' with a period of %d", method, period))
+		}
+	}
+	for region, max := range c.MaxInFlight {
+		if !seen[region] {
+			problems = append(problems, fmt.Sprintf("most requests in flight given for unconfigured region '%s'", region))
+		}
+		if max < 0 {
+			problems = append(problems, fmt.Sprintf("most requests in flight for region '%s' is negative", region))
+		}
+	}
+	problems = append(problems, c.HTTP.problems()...)
+	problems = append(problems, c.Retry.problems()...)
+	problems = append(problems, c.Cache.problems()...)
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("Invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func isKnownRegion(region string) bool {
+	for _, known := range KnownRegions {
+		if region == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Retry configures how requests which fail in a way that may not last, such
+// as with a 503 or a dropped connection, are sent again. Settings left as their
+// zero value keep the default policy.
+type Retry struct {
+	//The most times a request is sent, including the first. 1 to never retry.
+	MaxAttempts int
+	//How long to wait before the first retry, e.g. "500ms". Doubles with each
+	// retry after that.
+	Backoff time.Duration
+	//The longest to wait before any retry
+	MaxBackoff time.Duration
+	//Up to this fraction of each wait is taken off it at random, so that
+	// requests which failed together aren't retried together. From 0 to 1.
+	Jitter float64
+	//The HTTP statuses which are retried. Timeouts and broken connections are
+	// always retried. Requests turned away with a 429 are retried by the limiter
+	// regardless.
+	Statuses []int
+}
+
+// Cache configures where responses from the API are kept, so that lookups
+// repeated within their TTL are answered without making a request. Nothing is
+// cached when Backend is empty.
+type Cache struct {
+	//"memory" to keep responses in this process, "disk" to keep them in Dir,
+	// or empty for no cache
+	Backend string
+	//The directory the disk backend keeps responses in
+	Dir string
+	//The most responses the memory backend keeps, dropping the least recently
+	// used first. Zero for the default.
+	MaxEntries int
+	//How long summoners looked up by name are kept, e.g. "24h". Zero for the
+	// default.
+	SummonerTTL time.Duration
+	//How long recent game histories are kept, e.g. "5m". Zero for the default.
+	RecentGamesTTL time.Duration
+}
+
+// problems lists what is wrong with these cache settings, if anything.
+func (c Cache) problems() []string {
+	var ret []string
+	switch c.Backend {
+	case "", "memory":
+	case "disk":
+		if c.Dir == "" {
+			ret = append(ret, "no directory is configured for the disk cache")
+		}
+	default:
+		ret = append(ret, fmt.Sprintf("unknown cache backend '%s'", c.Backend))
+	}
+	if c.MaxEntries < 0 {
+		ret = append(ret, "the most cache entries is negative")
+	}
+	if c.SummonerTTL < 0 || c.RecentGamesTTL < 0 {
+		ret = append(ret, "a cache TTL is negative")
+	}
+	return ret
+}
+
+// problems lists what is wrong with these retry settings, if anything.
+func (r Retry) problems() []string {
+	var ret []string
+	if r.MaxAttempts < 0 {
+		ret = append(ret, "the most attempts for a request is negative")
+	}
+	if r.Backoff < 0 || r.MaxBackoff < 0 {
+		ret = append(ret, "the retry backoff is negative")
+	}
+	if r.Jitter < 0 || r.Jitter > 1 {
+		ret = append(ret, fmt.Sprintf("retry jitter %g is not between 0 and 1", r.Jitter))
+	}
+	for _, status := range r.Statuses {
+		if status < 100 || status > 599 {
+			ret = append(ret, fmt.Sprintf("retry status %d is not an HTTP status", status))
+		}
+	}
+	return ret
+}
+
+// problems lists what is wrong with these HTTP settings, if anything.
+func (h HTTP) problems() []string {
+	var ret []string
+	if h.BaseURL != "" && !isHTTPURL(strings.Replace(h.BaseURL, "%s", "na", -1)) {
+		ret = append(ret, fmt.Sprintf("base URL '%s' is not an http or https URL", h.BaseURL))
+	}
+	if h.Proxy != "" && !isHTTPURL(h.Proxy) {
+		ret = append(ret, fmt.Sprintf("proxy '%s' is not an http or https URL", h.Proxy))
+	}
+	if h.Timeout < 0 {
+		ret = append(ret, "the HTTP timeout is negative")
+	}
+	if h.DialTimeout < 0 {
+		ret = append(ret, "the HTTP dial timeout is negative")
+	}
+	return ret
+}
+
+func isHTTPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// duplicatePeriod returns a period which more than one of the given rates has,
+// if there is one.
+func duplicatePeriod(rates []types.Rate) (uint32, bool) {
+	seen := make(map[uint32]bool, len(rates))
+	for _, rate := range rates {
+		if seen[rate.Period] {
+			return rate.Period, true
+		}
+		seen[rate.Period] = true
+	}
+	return 0, false
 }
@@ -4,6 +4,7 @@ import (
 	"os"
 	"reflect"
 	"sort"
+	"time"
 
 	. "github.com/thomasmmitchell/recentlyplayedplus/config"
 	"github.com/thomasmmitchell/recentlyplayedplus/types"
@@ -135,4 +136,178 @@ var _ = Describe("Config", func() {
 			})
 		})
 	})
+
+	Context("When loading method rates", func() {
+		BeforeEach(func() {
+			configFile = "oneregmethods.yml"
+		})
+
+		It("should have rates for two methods", func() {
+			Ω(Methods()).Should(HaveLen(2))
+		})
+
+		Specify("each method should have the correct rates", func() {
+			Ω(Methods()).Should(HaveKeyWithValue("summoner", []types.Rate{{Period: 10, Max: 5}}))
+			Ω(Methods()).Should(HaveKeyWithValue("game", []types.Rate{{Period: 1, Max: 1}, {Period: 60, Max: 20}}))
+		})
+
+		Specify("the rates of the API key should be loaded alongside them", func() {
+			Ω(ratesAreCorrect([]types.Rate{{Period: 10, Max: 10}})).Should(BeTrue())
+		})
+	})
+
+	Context("When loading the most requests in flight", func() {
+		BeforeEach(func() {
+			configFile = "onereginflight.yml"
+		})
+
+		It("should load the cap of each region", func() {
+			Ω(MaxInFlight()).Should(Equal(map[string]int{"na": 4}))
+		})
+	})
+
+	Context("When loading HTTP settings", func() {
+		BeforeEach(func() {
+			configFile = "onereghttp.yml"
+		})
+
+		It("should load every setting", func() {
+			Ω(Current().HTTP).Should(Equal(HTTP{
+				BaseURL:     "http://localhost:8080/%s",
+				Proxy:       "http://proxy.example.com:3128",
+				Timeout:     10 * time.Second,
+				DialTimeout: 2 * time.Second,
+				UserAgent:   "recentlyplayedplus-test",
+			}))
+		})
+
+		It("should leave them out of configurations without them", func() {
+			Ω(LoadConfig(configPrefix + "oneregonerate.yml")).Should(Succeed())
+			Ω(Current().HTTP).Should(BeZero())
+		})
+	})
+
+	Context("When loading retry settings", func() {
+		BeforeEach(func() {
+			configFile = "oneregretry.yml"
+		})
+
+		It("should load every setting", func() {
+			Ω(Current().Retry).Should(Equal(Retry{
+				MaxAttempts: 5,
+				Backoff:     250 * time.Millisecond,
+				MaxBackoff:  5 * time.Second,
+				Jitter:      0.25,
+				Statuses:    []int{500, 503},
+			}))
+			Ω(Current().Validate()).Should(Succeed())
+		})
+	})
+
+	Context("When loading cache settings", func() {
+		BeforeEach(func() {
+			configFile = "oneregcache.yml"
+		})
+
+		It("should load every setting", func() {
+			Ω(Current().Cache).Should(Equal(Cache{
+				Backend:        "disk",
+				Dir:            "/var/cache/rpp",
+				MaxEntries:     100,
+				SummonerTTL:    12 * time.Hour,
+				RecentGamesTTL: 2 * time.Minute,
+			}))
+			Ω(Current().Validate()).Should(Succeed())
+		})
+	})
+
+	Context("When validating", func() {
+		BeforeEach(func() {
+			configFile = "manyregsonerate.yml"
+		})
+
+		It("should accept the loaded configuration", func() {
+			Ω(Current()).ShouldNot(BeNil())
+			Ω(Current().Validate()).Should(Succeed())
+		})
+
+		It("should reject unknown and repeated regions", func() {
+			conf := &Config{Regions: []string{"na", "atlantis", "na"}}
+			err := conf.Validate()
+			Ω(err).Should(MatchError(ContainSubstring("unknown region 'atlantis'")))
+			Ω(err).Should(MatchError(ContainSubstring("region 'na' is configured more than once")))
+		})
+
+		It("should reject a configuration without regions", func() {
+			Ω((&Config{}).Validate()).Should(MatchError(ContainSubstring("no regions")))
+		})
+
+		It("should reject rates which share a period", func() {
+			conf := &Config{
+				Regions: []string{"na"},
+				Methods: map[string][]types.Rate{"game": {{Period: 1, Max: 1}, {Period: 1, Max: 2}}},
+			}
+			Ω(conf.Validate()).Should(MatchError(ContainSubstring("method 'game' with a period of 1")))
+		})
+
+		It("should reject the most requests in flight for unconfigured regions, or below zero", func() {
+			conf := &Config{
+				Regions:     []string{"na"},
+				MaxInFlight: map[string]int{"na": -1, "euw": 2},
+			}
+			err := conf.Validate()
+			Ω(err).Should(MatchError(ContainSubstring("unconfigured region 'euw'")))
+			Ω(err).Should(MatchError(ContainSubstring("region 'na' is negative")))
+		})
+
+		It("should reject HTTP settings which can't be used", func() {
+			conf := &Config{
+				Regions: []string{"na"},
+				HTTP: HTTP{
+					BaseURL: "%s.api.pvp.net",
+					Proxy:   "ftp://proxy",
+					Timeout: -time.Second,
+				},
+			}
+			err := conf.Validate()
+			Ω(err).Should(MatchError(ContainSubstring("base URL '%s.api.pvp.net'")))
+			Ω(err).Should(MatchError(ContainSubstring("proxy 'ftp://proxy'")))
+			Ω(err).Should(MatchError(ContainSubstring("timeout is negative")))
+		})
+
+		It("should reject retry settings which can't be used", func() {
+			conf := &Config{
+				Regions: []string{"na"},
+				Retry: Retry{
+					MaxAttempts: -1,
+					Jitter:      1.5,
+					Statuses:    []int{5000},
+				},
+			}
+			err := conf.Validate()
+			Ω(err).Should(MatchError(ContainSubstring("most attempts for a request is negative")))
+			Ω(err).Should(MatchError(ContainSubstring("jitter 1.5")))
+			Ω(err).Should(MatchError(ContainSubstring("retry status 5000")))
+		})
+
+		It("should reject cache settings which can't be used", func() {
+			conf := &Config{
+				Regions: []string{"na"},
+				Cache:   Cache{Backend: "disk", SummonerTTL: -time.Hour},
+			}
+			err := conf.Validate()
+			Ω(err).Should(MatchError(ContainSubstring("no directory is configured for the disk cache")))
+			Ω(err).Should(MatchError(ContainSubstring("a cache TTL is negative")))
+			conf.Cache = Cache{Backend: "redis"}
+			Ω(conf.Validate()).Should(MatchError(ContainSubstring("unknown cache backend 'redis'")))
+		})
+
+		It("should accept a base URL without the region in it", func() {
+			conf := &Config{
+				Regions: []string{"na"},
+				HTTP:    HTTP{BaseURL: "http://127.0.0.1:8080"},
+			}
+			Ω(conf.Validate()).Should(Succeed())
+		})
+	})
 })
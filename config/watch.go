@@ -0,0 +1,76 @@
+package config
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// Watcher reloads a configuration file whenever it changes. See Watch.
+type Watcher struct {
+	path     string
+	onChange func(*Config, error)
+	//Closed to stop the watcher
+	stop     chan struct{}
+	stopOnce sync.Once
+	//What the file looked like when it was last loaded
+	modTime time.Time
+	size    int64
+}
+
+// Watch checks the YAML file at path every interval, and loads it with Load
+// whenever it has been modified since it was last loaded. After each reload
+// onChange is called with the configuration loaded, or with the error if the
+// file couldn't be loaded. The current configuration is left as it is; pass
+// the configuration to Use for that. The file is not loaded straight away.
+// Stop the returned Watcher once it is no longer needed.
+func Watch(path string, interval time.Duration, onChange func(*Config, error)) *Watcher {
+	w := &Watcher{
+		path:     path,
+		onChange: onChange,
+		stop:     make(chan struct{}),
+	}
+	if info, err := os.Stat(path); err == nil {
+		w.modTime, w.size = info.ModTime(), info.Size()
+	}
+	go w.run(interval)
+	return w
+}
+
+// Stop stops the watcher from checking the file. It is safe to call more
+// than once.
+func (w *Watcher) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+	})
+}
+
+func (w *Watcher) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+
+// check reloads the file if it has changed since it was last loaded.
+func (w *Watcher) check() {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		//The file may be part way through being replaced
+		return
+	}
+	if info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return
+	}
+	w.modTime, w.size = info.ModTime(), info.Size()
+	loaded, err := Load(w.path)
+	if w.onChange != nil {
+		w.onChange(loaded, err)
+	}
+}
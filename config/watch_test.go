@@ -0,0 +1,78 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/thomasmmitchell/recentlyplayedplus/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Watcher", func() {
+	var dir, path string
+	var watcher *Watcher
+	var changes chan error
+	var loaded chan *Config
+
+	write := func(contents string, modTime time.Time) {
+		Ω(ioutil.WriteFile(path, []byte(contents), 0644)).Should(Succeed())
+		Ω(os.Chtimes(path, modTime, modTime)).Should(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "config")
+		Ω(err).ShouldNot(HaveOccurred())
+		path = filepath.Join(dir, "rpp_conf.yml")
+		write("regions: [ na ]\n", time.Now().Add(-time.Hour))
+		Ω(LoadConfig(path)).Should(Succeed())
+		changes = make(chan error, 10)
+		loaded = make(chan *Config, 10)
+		watcher = Watch(path, 10*time.Millisecond, func(cfg *Config, err error) {
+			loaded <- cfg
+			changes <- err
+		})
+	})
+
+	AfterEach(func() {
+		watcher.Stop()
+		os.RemoveAll(dir)
+	})
+
+	It("should not reload a file which hasn't changed", func() {
+		Consistently(changes, "100ms").ShouldNot(Receive())
+		Ω(Regions()).Should(Equal([]string{"na"}))
+	})
+
+	It("should reload the file once it changes", func() {
+		write("regions: [ na, euw ]\n", time.Now())
+		Eventually(changes).Should(Receive(BeNil()))
+		var cfg *Config
+		Ω(loaded).Should(Receive(&cfg))
+		Ω(cfg.Regions).Should(Equal([]string{"na", "euw"}))
+		Consistently(changes, "100ms").ShouldNot(Receive())
+	})
+
+	It("should leave the current configuration as it is", func() {
+		write("regions: [ na, euw ]\n", time.Now())
+		Eventually(changes).Should(Receive(BeNil()))
+		Ω(Regions()).Should(Equal([]string{"na"}))
+	})
+
+	It("should report when the file can't be loaded", func() {
+		write("regions: [ na\n", time.Now())
+		Eventually(changes).Should(Receive(HaveOccurred()))
+		Ω(loaded).Should(Receive(BeNil()))
+	})
+
+	It("should stop checking once stopped", func() {
+		watcher.Stop()
+		write("regions: [ euw ]\n", time.Now())
+		Consistently(changes, "100ms").ShouldNot(Receive())
+		Ω(Regions()).Should(Equal([]string{"na"}))
+	})
+})
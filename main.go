@@ -1,5 +1,120 @@
 package main
 
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/thomasmmitchell/recentlyplayedplus/config"
+	"github.com/thomasmmitchell/recentlyplayedplus/request"
+	"github.com/thomasmmitchell/recentlyplayedplus/types"
+)
+
+// fellow tallies the games shared with a single other player.
+type fellow struct {
+	summonerID    int
+	games         int
+	winsWith      int
+	lossesWith    int
+	winsAgainst   int
+	lossesAgainst int
+}
+
 func main() {
+	confPath := flag.String("config", "raw/rpp_conf.yml", "Path to the YAML configuration file")
+	region := flag.String("region", "na", "Region that the summoner plays in")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <summoner name>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(*confPath, *region, flag.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(confPath, region, name string) error {
+	err := config.LoadConfig(confPath)
+	if err != nil {
+		return fmt.Errorf("Could not load config '%s': %s", confPath, err)
+	}
+	if err = request.Init(config.Current()); err != nil {
+		return fmt.Errorf("Could not use config '%s': %s", confPath, err)
+	}
+	summoners, notFound, err := request.GetSummoners(region, name)
+	if err != nil {
+		return fmt.Errorf("Could not look up summoner '%s': %s", name, err)
+	}
+	if len(notFound) > 0 {
+		return fmt.Errorf("No summoner named '%s' in region '%s'", name, region)
+	}
+	summoner := summoners[request.NormalizeName(name)]
+	matches, err := request.GetRecentGames(region, int64(summoner.ID), config.ApiKey())
+	if err != nil {
+		return fmt.Errorf("Could not retrieve recent games for '%s': %s", name, err)
+	}
+	printFellows(name, tallyFellows(matches))
+	return nil
+}
+
+// tallyFellows counts, for every player appearing in the given games, how many
+// games were shared with them and how those games went. Players are returned
+// ordered by the number of shared games, most first.
+func tallyFellows(matches types.Matchlist) []*fellow {
+	byID := make(map[int]*fellow)
+	for _, game := range matches.Games {
+		for _, player := range game.FellowPlayers {
+			f, ok := byID[player.SummonerID]
+			if !ok {
+				f = &fellow{summonerID: player.SummonerID}
+				byID[player.SummonerID] = f
+			}
+			f.games++
+			together := player.TeamID == game.TeamID
+			switch {
+			case together && game.Stats.Win:
+				f.winsWith++
+			case together:
+				f.lossesWith++
+			case game.Stats.Win:
+				f.winsAgainst++
+			default:
+				f.lossesAgainst++
+			}
+		}
+	}
+	ret := make([]*fellow, 0, len(byID))
+	for _, f := range byID {
+		ret = append(ret, f)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].games != ret[j].games {
+			return ret[i].games > ret[j].games
+		}
+		return ret[i].summonerID < ret[j].summonerID
+	})
+	return ret
+}
 
+func printFellows(name string, fellows []*fellow) {
+	if len(fellows) == 0 {
+		fmt.Printf("%s has not recently played with anybody.\n", name)
+		return
+	}
+	lastGames := 0
+	for _, f := range fellows {
+		if f.games != lastGames {
+			lastGames = f.games
+			fmt.Printf("\nPlayed %d game(s) with:\n", f.games)
+		}
+		fmt.Printf("  Summoner %-12d together: %d-%d  opposing: %d-%d\n",
+			f.summonerID, f.winsWith, f.lossesWith, f.winsAgainst, f.lossesAgainst)
+	}
 }
@@ -0,0 +1,13 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestRecentlyplayedplus(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Recentlyplayedplus Suite")
+}
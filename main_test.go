@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/thomasmmitchell/recentlyplayedplus/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+//Builds a Matchlist from its JSON, because the nested anonymous structs make
+// literals of it unwieldy.
+func matchlistFrom(body string) types.Matchlist {
+	ret := types.Matchlist{}
+	err := json.Unmarshal([]byte(body), &ret)
+	Ω(err).ShouldNot(HaveOccurred(), "The test matchlist should be valid JSON")
+	return ret
+}
+
+var _ = Describe("Recentlyplayedplus", func() {
+	Context("When tallying fellow players", func() {
+		It("should have nobody to tally for no games", func() {
+			fellows := tallyFellows(matchlistFrom(`{"games": []}`))
+			Ω(fellows).Should(BeEmpty())
+		})
+
+		It("should count wins and losses with and against each player", func() {
+			fellows := tallyFellows(matchlistFrom(`{"games": [
+				{"teamId": 100, "stats": {"win": true}, "fellowPlayers": [
+					{"summonerId": 1, "teamId": 100},
+					{"summonerId": 2, "teamId": 200}]},
+				{"teamId": 200, "stats": {"win": false}, "fellowPlayers": [
+					{"summonerId": 1, "teamId": 200},
+					{"summonerId": 2, "teamId": 100}]},
+				{"teamId": 100, "stats": {"win": false}, "fellowPlayers": [
+					{"summonerId": 1, "teamId": 200}]}
+			]}`))
+			Ω(fellows).Should(Equal([]*fellow{
+				{summonerID: 1, games: 3, winsWith: 1, lossesWith: 1, lossesAgainst: 1},
+				{summonerID: 2, games: 2, winsAgainst: 1, lossesAgainst: 1},
+			}))
+		})
+
+		It("should order players sharing as many games by summoner ID", func() {
+			fellows := tallyFellows(matchlistFrom(`{"games": [
+				{"teamId": 100, "stats": {"win": true}, "fellowPlayers": [
+					{"summonerId": 30, "teamId": 100},
+					{"summonerId": 10, "teamId": 100},
+					{"summonerId": 20, "teamId": 200}]}
+			]}`))
+			ids := make([]int, 0, len(fellows))
+			for _, f := range fellows {
+				ids = append(ids, f.summonerID)
+			}
+			Ω(ids).Should(Equal([]int{10, 20, 30}))
+		})
+	})
+})
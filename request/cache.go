@@ -0,0 +1,144 @@
+package request
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/thomasmmitchell/recentlyplayedplus/config"
+)
+
+// Cache keeps responses from the API, so that a Client can answer lookups it
+// has made recently without making a request or waiting on its Limiter.
+// Implementations must be safe for concurrent use.
+type Cache interface {
+	// Get returns the value stored under key, unless its TTL has passed.
+	Get(key string) ([]byte, bool)
+	// Set stores value under key, to be returned by Get until ttl has passed.
+	Set(key string, value []byte, ttl time.Duration) error
+}
+
+// CacheTTLs are how long a Client keeps the responses of each kind of lookup.
+type CacheTTLs struct {
+	Summoner    time.Duration
+	RecentGames time.Duration
+}
+
+// DefaultCacheTTLs are the TTLs a Client uses unless configured otherwise.
+// Summoners rarely change their names, whereas their recent games change with
+// every game played.
+var DefaultCacheTTLs = CacheTTLs{
+	Summoner:    24 * time.Hour,
+	RecentGames: 5 * time.Minute,
+}
+
+// defaultCacheEntries is the most responses a MemoryCache made from a
+// configuration keeps, unless configured otherwise.
+const defaultCacheEntries = 10000
+
+// cacheTTLsFrom makes CacheTTLs from the cache settings of a configuration,
+// taking the TTLs left out from DefaultCacheTTLs.
+func cacheTTLsFrom(cfg config.Cache) CacheTTLs {
+	ret := DefaultCacheTTLs
+	if cfg.SummonerTTL != 0 {
+		ret.Summoner = cfg.SummonerTTL
+	}
+	if cfg.RecentGamesTTL != 0 {
+		ret.RecentGames = cfg.RecentGamesTTL
+	}
+	return ret
+}
+
+// newCache makes the Cache described by the cache settings of a
+// configuration. Returns nil if no backend is configured.
+func newCache(cfg config.Cache) (Cache, error) {
+	switch cfg.Backend {
+	case "memory":
+		maxEntries := cfg.MaxEntries
+		if maxEntries == 0 {
+			maxEntries = defaultCacheEntries
+		}
+		return NewMemoryCache(maxEntries), nil
+	case "disk":
+		return NewDiskCache(cfg.Dir)
+	}
+	return nil, nil
+}
+
+// MemoryCache is a Cache which keeps its values in the memory of this process,
+// dropping the least recently used once it holds as many as it can.
+type MemoryCache struct {
+	maxEntries int
+	lock       sync.Mutex
+	//Most recently used first
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// NewMemoryCache creates an empty MemoryCache which holds up to maxEntries
+// values. maxEntries of zero or less is taken as one.
+func NewMemoryCache(maxEntries int) *MemoryCache {
+	if maxEntries < 1 {
+		maxEntries = 1
+	}
+	return &MemoryCache{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// Get implements Cache.
+func (c *MemoryCache) Get(key string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !time.Now().Before(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.value, true
+}
+
+// Set implements Cache.
+func (c *MemoryCache) Set(key string, value []byte, ttl time.Duration) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry := &cacheEntry{
+		key:     key,
+		value:   append([]byte(nil), value...),
+		expires: time.Now().Add(ttl),
+	}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return nil
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+	return nil
+}
+
+// Len returns the number of values in the cache, including any whose TTL has
+// passed without them being looked up since.
+func (c *MemoryCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,173 @@
+package request_test
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/thomasmmitchell/recentlyplayedplus/config"
+	. "github.com/thomasmmitchell/recentlyplayedplus/request"
+	"github.com/thomasmmitchell/recentlyplayedplus/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cache", func() {
+	Context("When keeping values in memory", func() {
+		var cache *MemoryCache
+
+		BeforeEach(func() {
+			cache = NewMemoryCache(2)
+		})
+
+		It("should return values until their TTL passes", func() {
+			Ω(cache.Set("a", []byte("1"), 50*time.Millisecond)).Should(Succeed())
+			value, ok := cache.Get("a")
+			Ω(ok).Should(BeTrue())
+			Ω(value).Should(Equal([]byte("1")))
+			Eventually(func() bool {
+				_, ok := cache.Get("a")
+				return ok
+			}).Should(BeFalse())
+			Ω(cache.Len()).Should(BeZero(), "Expired values should be dropped once looked up")
+		})
+
+		It("should drop the least recently used value once full", func() {
+			cache.Set("a", []byte("1"), time.Hour)
+			cache.Set("b", []byte("2"), time.Hour)
+			cache.Get("a")
+			cache.Set("c", []byte("3"), time.Hour)
+			Ω(cache.Len()).Should(Equal(2))
+			_, ok := cache.Get("b")
+			Ω(ok).Should(BeFalse())
+			_, ok = cache.Get("a")
+			Ω(ok).Should(BeTrue())
+			_, ok = cache.Get("c")
+			Ω(ok).Should(BeTrue())
+		})
+
+		It("should replace values set again", func() {
+			cache.Set("a", []byte("1"), time.Hour)
+			cache.Set("a", []byte("2"), time.Hour)
+			value, _ := cache.Get("a")
+			Ω(value).Should(Equal([]byte("2")))
+			Ω(cache.Len()).Should(Equal(1))
+		})
+	})
+
+	Context("When keeping values on disk", func() {
+		var dir string
+		var cache *DiskCache
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "cache")
+			Ω(err).ShouldNot(HaveOccurred())
+			cache, err = NewDiskCache(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should return values until their TTL passes", func() {
+			Ω(cache.Set("summoner/na/some one", []byte("1"), 50*time.Millisecond)).Should(Succeed())
+			value, ok := cache.Get("summoner/na/some one")
+			Ω(ok).Should(BeTrue())
+			Ω(value).Should(Equal([]byte("1")))
+			Eventually(func() bool {
+				_, ok := cache.Get("summoner/na/some one")
+				return ok
+			}).Should(BeFalse())
+			files, _ := ioutil.ReadDir(dir)
+			Ω(files).Should(BeEmpty(), "Expired values should be removed once looked up")
+		})
+
+		It("should share values with other caches in the same directory", func() {
+			cache.Set("a", []byte("1"), time.Hour)
+			other, err := NewDiskCache(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+			value, ok := other.Get("a")
+			Ω(ok).Should(BeTrue())
+			Ω(value).Should(Equal([]byte("1")))
+		})
+
+		It("should miss values it doesn't have", func() {
+			_, ok := cache.Get("a")
+			Ω(ok).Should(BeFalse())
+		})
+	})
+
+	Context("When a client has a cache", func() {
+		api := withFakeAPI()
+
+		BeforeEach(func() {
+			api.server.AddSummoner("na", types.Summoner{Name: "Some One", ID: 42})
+			api.server.AddSummoner("na", types.Summoner{Name: "Other", ID: 43})
+			//Any request beyond the first would wait a minute
+			api.cfg.Rates = []types.Rate{{Period: 60, Max: 1}}
+			api.cfg.Cache = config.Cache{Backend: "memory"}
+		})
+
+		It("should answer repeated summoner lookups without the limiter", func() {
+			summoners, _, err := api.client.GetSummoners("na", "Some One")
+			Ω(err).ShouldNot(HaveOccurred())
+			again, notFound, err := api.client.GetSummoners("na", "SOMEONE")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(notFound).Should(BeEmpty())
+			Ω(again).Should(Equal(summoners))
+			Ω(api.server.Hits()).Should(HaveLen(1))
+		})
+
+		It("should answer repeated recent game lookups without the limiter", func() {
+			games, err := api.client.GetRecentGames("na", 42)
+			Ω(err).ShouldNot(HaveOccurred())
+			again, err := api.client.GetRecentGames("na", 42)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(again).Should(Equal(games))
+			Ω(api.server.Hits()).Should(HaveLen(1))
+		})
+
+		It("should only look up the summoners it doesn't have", func() {
+			api.client.GetSummoners("na", "Some One")
+			api.client.Limiter().UpdateRates("na", []types.Rate{{Period: 60, Max: 2}})
+			summoners, notFound, err := api.client.GetSummoners("na", "Some One", "Other", "nobody")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(summoners).Should(HaveLen(2))
+			Ω(notFound).Should(Equal([]string{"nobody"}))
+			hits := api.server.Hits()
+			Ω(hits).Should(HaveLen(2))
+			Ω(hits[1].Path).Should(HaveSuffix("/by-name/other,nobody"))
+		})
+
+		Context("With short TTLs", func() {
+			BeforeEach(func() {
+				api.cfg.Rates = nil
+				api.cfg.Cache.RecentGamesTTL = 50 * time.Millisecond
+			})
+
+			It("should look up again once the TTL passes", func() {
+				api.client.GetRecentGames("na", 42)
+				time.Sleep(100 * time.Millisecond)
+				api.client.GetRecentGames("na", 42)
+				Ω(api.server.Hits()).Should(HaveLen(2))
+			})
+		})
+
+		It("should use the cache set on the client over the configuration's", func() {
+			cache := NewMemoryCache(10)
+			api.client.SetCache(cache)
+			api.client.GetRecentGames("na", 42)
+			Ω(cache.Len()).Should(Equal(1))
+		})
+
+		It("should keep its cache when reconfigured with the same cache settings", func() {
+			api.client.GetRecentGames("na", 42)
+			Ω(api.client.Reconfigure(api.cfg)).Should(Succeed())
+			api.client.GetRecentGames("na", 42)
+			Ω(api.server.Hits()).Should(HaveLen(1))
+		})
+	})
+})
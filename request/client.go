@@ -0,0 +1,433 @@
+package request
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thomasmmitchell/recentlyplayedplus/config"
+	"github.com/thomasmmitchell/recentlyplayedplus/types"
+)
+
+// defaultBaseURL is the base URL of the API for a region, given the region's
+// name.
+const defaultBaseURL = "https://%s.api.pvp.net"
+
+// Client makes requests to the Riot API with the API key, regions, rates and
+// HTTP settings of a configuration. Each Client waits on a Limiter of its own,
+// so Clients with different API keys don't hold each other up. Client is safe
+// for concurrent use.
+type Client struct {
+	lim *Limiter
+	//Guards everything below, which changes when the Client is reconfigured
+	lock   sync.RWMutex
+	apiKey string
+	//The HTTP settings of the configuration, and how they were given
+	configured    httpSettings
+	configuredFor config.HTTP
+	retry         RetryPolicy
+	//The cache of the configuration, and how it was given
+	cache     Cache
+	cacheFor  config.Cache
+	cacheTTLs CacheTTLs
+	//Settings made on the Client itself, which take precedence over those of
+	// the configuration
+	overrides     httpSettings
+	retryOverride *RetryPolicy
+	cacheOverride Cache
+	//Requests in progress, keyed by endpoint, which identical requests wait on
+	// rather than being made again. Guarded by flightLock.
+	flights    map[string]*flight
+	flightLock sync.Mutex
+}
+
+// httpSettings are how a Client sends requests. Empty fields are left to
+// whatever settings they are combined with.
+type httpSettings struct {
+	//Formatted with a region's name, if it contains %s, to get the base URL
+	// of the region's API
+	baseURL   string
+	userAgent string
+	client    *http.Client
+}
+
+// or returns these settings, with the empty ones taken from fallback.
+func (s httpSettings) or(fallback httpSettings) httpSettings {
+	if s.baseURL == "" {
+		s.baseURL = fallback.baseURL
+	}
+	if s.userAgent == "" {
+		s.userAgent = fallback.userAgent
+	}
+	if s.client == nil {
+		s.client = fallback.client
+	}
+	return s
+}
+
+// defaultHTTP is what a Client uses where neither it nor its configuration
+// says otherwise. Requests are sent with http.DefaultClient as it is when they
+// are made, so that replacing it still has an effect.
+var defaultHTTP = httpSettings{
+	baseURL: defaultBaseURL,
+}
+
+// NewClient creates a Client configured with cfg, waiting on a Limiter which
+// keeps its counts in memory. Errs if cfg is nil or fails validation.
+func NewClient(cfg *config.Config) (*Client, error) {
+	lim := NewLimiter()
+	c, err := NewClientWithLimiter(cfg, lim)
+	if err != nil {
+		lim.Stop(context.Background(), RejectQueued)
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClientWithLimiter creates a Client configured with cfg, waiting on lim,
+// such as a Limiter using a RateStore shared with other processes. lim is
+// configured with the regions and rates of cfg, as by Limiter.Configure.
+// Errs if cfg is nil or fails validation.
+func NewClientWithLimiter(cfg *config.Config, lim *Limiter) (*Client, error) {
+	c := &Client{
+		lim:     lim,
+		flights: make(map[string]*flight),
+	}
+	if err := c.Reconfigure(cfg); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reconfigure applies cfg to this Client. The regions and rates of cfg are
+// applied to the Client's Limiter as by Limiter.Configure, and each region is
+// capped at the most requests in flight cfg gives for it, or left uncapped if
+// none is, as by Limiter.SetMaxInFlight. Requests made from then on use the
+// API key, HTTP settings, retry policy and cache of cfg, except where they
+// have been set on the Client itself. The cache is only replaced if its
+// settings have changed. Errs if cfg is nil or fails validation, leaving the
+// Client as it was.
+func (c *Client) Reconfigure(cfg *config.Config) error {
+	if cfg == nil {
+		return errors.New("Cannot configure a client without a configuration")
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	c.lock.RLock()
+	configured, changed := c.configured, c.configuredFor != cfg.HTTP
+	cache, cacheChanged := c.cache, c.cacheFor != cfg.Cache
+	c.lock.RUnlock()
+	if changed {
+		var err error
+		if configured, err = newHTTPSettings(cfg.HTTP); err != nil {
+			return err
+		}
+	}
+	if cacheChanged {
+		var err error
+		if cache, err = newCache(cfg.Cache); err != nil {
+			return fmt.Errorf("Could not create cache: %s", err)
+		}
+	}
+	if err := c.lim.Configure(cfg.Regions, cfg.Rates, cfg.Methods); err != nil {
+		return err
+	}
+	//Regions may have just been added, so every region is capped afresh
+	for _, region := range cfg.Regions {
+		if err := c.lim.SetMaxInFlight(region, cfg.MaxInFlight[region]); err != nil {
+			return err
+		}
+	}
+	c.lock.Lock()
+	c.apiKey = cfg.APIKey
+	old := c.configured.client
+	c.configured, c.configuredFor = configured, cfg.HTTP
+	c.retry = retryPolicyFrom(cfg.Retry)
+	c.cache, c.cacheFor, c.cacheTTLs = cache, cfg.Cache, cacheTTLsFrom(cfg.Cache)
+	c.lock.Unlock()
+	if changed && old != nil {
+		old.CloseIdleConnections()
+	}
+	return nil
+}
+
+// newHTTPSettings makes the settings which a Client sends requests with from
+// the HTTP settings of a configuration.
+func newHTTPSettings(cfg config.HTTP) (httpSettings, error) {
+	ret := httpSettings{
+		baseURL:   cfg.BaseURL,
+		userAgent: cfg.UserAgent,
+	}
+	if cfg == (config.HTTP{BaseURL: cfg.BaseURL, UserAgent: cfg.UserAgent}) {
+		return ret, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.Proxy != "" {
+		proxy, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return httpSettings{}, fmt.Errorf("Could not use proxy '%s': %s", cfg.Proxy, err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if cfg.DialTimeout > 0 {
+		transport.DialContext = (&net.Dialer{
+			Timeout:   cfg.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+	ret.client = &http.Client{
+		Transport: transport,
+		Timeout:   cfg.Timeout,
+	}
+	return ret, nil
+}
+
+// SetHTTPClient has this Client send requests with hc, such as one with a
+// transport of its own, in place of the one made from the configuration's
+// proxy and timeouts. nil goes back to the configuration's.
+func (c *Client) SetHTTPClient(hc *http.Client) {
+	c.lock.Lock()
+	c.overrides.client = hc
+	c.lock.Unlock()
+}
+
+// SetBaseURL has this Client send requests to baseURL, in which %s is replaced
+// by the name of the region being requested, in place of the configuration's
+// base URL. "" goes back to the configuration's.
+func (c *Client) SetBaseURL(baseURL string) {
+	c.lock.Lock()
+	c.overrides.baseURL = baseURL
+	c.lock.Unlock()
+}
+
+// SetUserAgent has this Client send userAgent as the User-Agent header of its
+// requests, in place of the configuration's. "" goes back to the
+// configuration's.
+func (c *Client) SetUserAgent(userAgent string) {
+	c.lock.Lock()
+	c.overrides.userAgent = userAgent
+	c.lock.Unlock()
+}
+
+// SetRetryPolicy has this Client retry failed requests according to policy, in
+// place of the configuration's policy. nil goes back to the configuration's.
+func (c *Client) SetRetryPolicy(policy *RetryPolicy) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if policy == nil {
+		c.retryOverride = nil
+		return
+	}
+	copied := *policy
+	c.retryOverride = &copied
+}
+
+// SetCache has this Client keep responses in cache, in place of the
+// configuration's cache. The configuration's TTLs still apply. nil goes back
+// to the configuration's cache.
+func (c *Client) SetCache(cache Cache) {
+	c.lock.Lock()
+	c.cacheOverride = cache
+	c.lock.Unlock()
+}
+
+// cached returns the Cache this Client keeps responses in, if any, and how
+// long it keeps them.
+func (c *Client) cached() (Cache, CacheTTLs) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.cacheOverride != nil {
+		return c.cacheOverride, c.cacheTTLs
+	}
+	return c.cache, c.cacheTTLs
+}
+
+// WatchConfig reloads the configuration file at path whenever it changes, as
+// config.Watch does, and applies it to this Client as Reconfigure does.
+// onChange, if not nil, is called after each reload with the error loading or
+// applying the file, if any.
+func (c *Client) WatchConfig(path string, interval time.Duration, onChange func(error)) *config.Watcher {
+	return config.Watch(path, interval, func(cfg *config.Config, err error) {
+		if err == nil {
+			err = c.Reconfigure(cfg)
+		}
+		if onChange != nil {
+			onChange(err)
+		}
+	})
+}
+
+// Limiter returns the Limiter which this Client's requests wait on.
+func (c *Client) Limiter() *Limiter {
+	return c.lim
+}
+
+// MetricsHandler serves the metrics of this Client's Limiter in the Prometheus
+// text format. See Limiter.MetricsHandler.
+func (c *Client) MetricsHandler() http.Handler {
+	return c.lim.MetricsHandler()
+}
+
+// Stop stops this Client's Limiter, rejecting requests still waiting on it.
+// See Limiter.Stop.
+func (c *Client) Stop(ctx context.Context) error {
+	return c.lim.Stop(ctx, RejectQueued)
+}
+
+// GetRecentGames retrieves a summoner's recent match history, given their
+// region and region-unique SummonerID.
+func (c *Client) GetRecentGames(region string, summonerid int64) (types.Matchlist, error) {
+	return c.GetRecentGamesContext(context.Background(), region, summonerid)
+}
+
+// GetRecentGamesContext is GetRecentGames, but gives up once ctx is done. If
+// the request is still waiting on the Limiter at that point, it is withdrawn
+// from the queue without ever being sent. Returns ctx.Err() when giving up.
+// Histories in the Client's cache are returned without making a request.
+func (c *Client) GetRecentGamesContext(ctx context.Context, region string, summonerid int64) (types.Matchlist, error) {
+	cache, ttls := c.cached()
+	key := fmt.Sprintf("game/%s/%d", region, summonerid)
+	ret := types.Matchlist{}
+	if cache != nil {
+		if response, ok := cache.Get(key); ok && json.Unmarshal(response, &ret) == nil {
+			return ret, nil
+		}
+		ret = types.Matchlist{}
+	}
+	endpoint := fmt.Sprintf("/api/lol/%s/v1.3/game/by-summoner/%d", region, summonerid)
+	response, err := c.fetch(ctx, region, MethodGame, endpoint)
+	if err != nil {
+		return types.Matchlist{}, err
+	}
+	if err = json.Unmarshal(response, &ret); err != nil {
+		return types.Matchlist{}, fmt.Errorf("Could not read recent games: %s", err)
+	}
+	if cache != nil {
+		//The response is still good without being cached
+		cache.Set(key, response, ttls.RecentGames)
+	}
+	return ret, nil
+}
+
+// fetchRetrying requests the endpoint for the callers waiting on f, retrying
+// according to the Client's RetryPolicy, until it has the response body, the
+// request has failed for good, or ctx is done.
+func (c *Client) fetchRetrying(ctx context.Context, f *flight, region, method, endpoint string) ([]byte, error) {
+	c.lock.RLock()
+	policy := c.retry
+	if c.retryOverride != nil {
+		policy = *c.retryOverride
+	}
+	c.lock.RUnlock()
+	for attempts := 1; ; attempts++ {
+		response, err := c.fetchOnce(ctx, f, region, method, endpoint)
+		if err == nil || attempts >= policy.MaxAttempts || !policy.retryable(ctx, err) {
+			return response, err
+		}
+		timer := time.NewTimer(policy.backoff(attempts, err))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// fetchOnce queues a request for the endpoint with the limiter, at the
+// priority of f, and waits for either its response body or for ctx to be done,
+// whichever happens first.
+func (c *Client) fetchOnce(ctx context.Context, f *flight, region, method, endpoint string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	//Held while queueing, so that callers joining f either find the request
+	// queued or have their priority queued with it
+	c.flightLock.Lock()
+	req := c.newRequest(ctx, region, method, endpoint, f.priority)
+	//The remaining allowance is reported by the Limiter's metrics instead
+	_, err := c.lim.EnqueuePriority(req, region, method, req.priority)
+	if err == nil {
+		f.queued = req
+	}
+	c.flightLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case response := <-req.body:
+		return response, nil
+	case err = <-req.err:
+		return nil, err
+	case <-ctx.Done():
+		// If the request was already released it is sent with ctx, so the
+		// HTTP call is abandoned too. Its channels are buffered, so nothing
+		// is left blocked on them.
+		c.lim.Cancel(req, region)
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) newRequest(ctx context.Context, region, method, endpoint string, priority Priority) *request {
+	c.lock.RLock()
+	apiKey := c.apiKey
+	settings := c.overrides.or(c.configured).or(defaultHTTP)
+	c.lock.RUnlock()
+	if settings.client == nil {
+		settings.client = http.DefaultClient
+	}
+	return &request{
+		ctx:        ctx,
+		client:     c,
+		httpClient: keepKeyOnHost(settings.client),
+		userAgent:  settings.userAgent,
+		region:     region,
+		method:     method,
+		priority:   priority,
+		endpoint:   endpoint,
+		url:        baseURL(settings.baseURL, region) + endpoint,
+		apiKey:     apiKey,
+		body:       make(chan []byte, 1),
+		err:        make(chan error, 1),
+	}
+}
+
+// baseURL fills in the region of a base URL template. Templates without %s
+// are the same for every region.
+func baseURL(template, region string) string {
+	if !strings.Contains(template, "%s") {
+		return template
+	}
+	return strings.Replace(template, "%s", region, -1)
+}
+
+// keepKeyOnHost returns a copy of hc which drops the API key header from
+// requests it redirects to a host other than that of the original request.
+// net/http only does so for the headers it knows to be sensitive, so the key
+// would otherwise go wherever a proxy or base URL redirects it.
+func keepKeyOnHost(hc *http.Client) *http.Client {
+	copied := *hc
+	checkRedirect := hc.CheckRedirect
+	copied.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if req.URL.Host != via[0].URL.Host {
+			req.Header.Del(apiKeyHeader)
+		}
+		if checkRedirect != nil {
+			return checkRedirect(req, via)
+		}
+		//As net/http does by default
+		if len(via) >= 10 {
+			return errors.New("Stopped after 10 redirects")
+		}
+		return nil
+	}
+	return &copied
+}
@@ -0,0 +1,241 @@
+package request_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/thomasmmitchell/recentlyplayedplus/config"
+	. "github.com/thomasmmitchell/recentlyplayedplus/request"
+	"github.com/thomasmmitchell/recentlyplayedplus/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Client", func() {
+	regions := func(client *Client) []string {
+		metrics, err := client.Limiter().Metrics()
+		Ω(err).ShouldNot(HaveOccurred())
+		ret := []string{}
+		for _, m := range metrics {
+			ret = append(ret, m.Region)
+		}
+		return ret
+	}
+
+	It("should not be created without a valid configuration", func() {
+		_, err := NewClient(nil)
+		Ω(err).Should(MatchError("Cannot configure a client without a configuration"))
+		_, err = NewClient(&config.Config{Regions: []string{"atlantis"}})
+		Ω(err).Should(MatchError(ContainSubstring("atlantis")))
+	})
+
+	Context("When there are two clients", func() {
+		var first, second *Client
+
+		BeforeEach(func() {
+			var err error
+			first, err = NewClient(&config.Config{
+				APIKey:  "first",
+				Regions: []string{"na"},
+				Rates:   []types.Rate{{Period: 10, Max: 1}},
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+			second, err = NewClient(&config.Config{
+				APIKey:  "second",
+				Regions: []string{"na", "euw"},
+				Rates:   []types.Rate{{Period: 10, Max: 1}},
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			first.Stop(context.Background())
+			second.Stop(context.Background())
+		})
+
+		It("should give each its own limiter", func() {
+			Ω(first.Limiter()).ShouldNot(BeIdenticalTo(second.Limiter()))
+			Ω(regions(first)).Should(Equal([]string{"na"}))
+			Ω(regions(second)).Should(Equal([]string{"euw", "na"}))
+			_, err := first.Limiter().Enqueue(newTestDoer(1), "na")
+			Ω(err).ShouldNot(HaveOccurred())
+			metrics, err := second.Limiter().Metrics()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(metrics[1].Allowance).Should(Equal(map[uint32]uint32{10: 1}), "The other client's allowance should be untouched")
+		})
+
+		It("should reconfigure one without affecting the other", func() {
+			Ω(first.Reconfigure(&config.Config{Regions: []string{"kr"}})).Should(Succeed())
+			Ω(regions(first)).Should(Equal([]string{"kr"}))
+			Ω(regions(second)).Should(Equal([]string{"euw", "na"}))
+		})
+
+		It("should be left as it was by an invalid configuration", func() {
+			Ω(first.Reconfigure(&config.Config{Regions: []string{"atlantis"}})).ShouldNot(Succeed())
+			Ω(regions(first)).Should(Equal([]string{"na"}))
+		})
+	})
+
+	Context("When capping the requests in flight", func() {
+		var client *Client
+		var cfg *config.Config
+		var blockers []*BlockingTestDoer
+
+		//Starts a task for the region which runs until the spec is over
+		block := func(region string) {
+			blocker := newBlockingTestDoer(0)
+			blockers = append(blockers, blocker)
+			_, err := client.Limiter().Enqueue(blocker, region)
+			Ω(err).ShouldNot(HaveOccurred())
+			Eventually(blocker.started).Should(BeClosed(), "The task should be performed straight away")
+		}
+
+		BeforeEach(func() {
+			blockers = nil
+			cfg = &config.Config{
+				Regions:     []string{"na", "euw"},
+				MaxInFlight: map[string]int{"na": 1},
+			}
+			var err error
+			client, err = NewClient(cfg)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			for _, blocker := range blockers {
+				blocker.finish()
+			}
+			client.Stop(context.Background())
+		})
+
+		It("should hold each region to the cap configured for it", func() {
+			block("na")
+			doer := newTestDoer(1)
+			_, err := client.Limiter().Enqueue(doer, "na")
+			Ω(err).ShouldNot(HaveOccurred())
+			_, retrieved := doer.wait(settleTime)
+			Ω(retrieved).Should(BeFalse(), "The capped region should hold the task back")
+			block("euw")
+			block("euw")
+		})
+
+		It("should lift the cap of a region once it is left out", func() {
+			block("na")
+			doer := newTestDoer(1)
+			_, err := client.Limiter().Enqueue(doer, "na")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(client.Reconfigure(&config.Config{Regions: cfg.Regions})).Should(Succeed())
+			_, retrieved := doer.wait(time.Second)
+			Ω(retrieved).Should(BeTrue(), "The task should be performed once the cap is lifted")
+		})
+
+		It("should keep capping a region removed and added again", func() {
+			Ω(client.Reconfigure(&config.Config{Regions: []string{"euw"}})).Should(Succeed())
+			Ω(client.Reconfigure(cfg)).Should(Succeed())
+			block("na")
+			doer := newTestDoer(1)
+			_, err := client.Limiter().Enqueue(doer, "na")
+			Ω(err).ShouldNot(HaveOccurred())
+			_, retrieved := doer.wait(settleTime)
+			Ω(retrieved).Should(BeFalse(), "The region added again should be capped")
+		})
+	})
+
+	Context("When sending requests", func() {
+		var server *httptest.Server
+		var received chan *http.Request
+		var delay time.Duration
+		var client *Client
+
+		newClient := func(settings config.HTTP) {
+			var err error
+			client, err = NewClient(&config.Config{
+				APIKey:  "key",
+				Regions: []string{"na"},
+				HTTP:    settings,
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+
+		BeforeEach(func() {
+			delay = 0
+			received = make(chan *http.Request, 10)
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received <- r
+				time.Sleep(delay)
+				w.Write([]byte(`{}`))
+			}))
+		})
+
+		AfterEach(func() {
+			client.Stop(context.Background())
+			server.Close()
+		})
+
+		It("should send them to the configured base URL with the configured user agent", func() {
+			newClient(config.HTTP{
+				BaseURL:   server.URL + "/%s",
+				UserAgent: "rpp-test",
+			})
+			_, _, err := client.GetSummoners("na", "someone")
+			Ω(err).ShouldNot(HaveOccurred())
+			var r *http.Request
+			Ω(received).Should(Receive(&r))
+			Ω(r.URL.Path).Should(Equal("/na/api/lol/na/v1.4/summoner/by-name/someone"))
+			Ω(r.Header.Get("X-Riot-Token")).Should(Equal("key"))
+			Ω(r.URL.RawQuery).Should(BeEmpty(), "The API key should be kept out of the URL")
+			Ω(r.Header.Get("User-Agent")).Should(Equal("rpp-test"))
+		})
+
+		It("should prefer the settings made on the client", func() {
+			newClient(config.HTTP{
+				BaseURL:   "http://127.0.0.1:1/%s",
+				UserAgent: "rpp-test",
+			})
+			client.SetBaseURL(server.URL)
+			client.SetUserAgent("rpp-override")
+			_, err := client.GetRecentGames("na", 1)
+			Ω(err).ShouldNot(HaveOccurred())
+			var r *http.Request
+			Ω(received).Should(Receive(&r))
+			Ω(r.URL.Path).Should(Equal("/api/lol/na/v1.3/game/by-summoner/1"))
+			Ω(r.Header.Get("User-Agent")).Should(Equal("rpp-override"))
+		})
+
+		It("should give up on requests which take longer than the configured timeout", func() {
+			delay = 500 * time.Millisecond
+			newClient(config.HTTP{
+				BaseURL: server.URL,
+				Timeout: 50 * time.Millisecond,
+			})
+			client.SetRetryPolicy(&NoRetries)
+			start := time.Now()
+			_, _, err := client.GetSummoners("na", "someone")
+			Ω(err).Should(HaveOccurred())
+			Ω(time.Since(start)).Should(BeNumerically("<", delay))
+		})
+
+		It("should send them with the HTTP client it is given", func() {
+			newClient(config.HTTP{BaseURL: server.URL})
+			var sent int
+			client.SetHTTPClient(&http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					sent++
+					return http.DefaultTransport.RoundTrip(r)
+				}),
+			})
+			_, _, err := client.GetSummoners("na", "someone")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(sent).Should(Equal(1))
+		})
+	})
+})
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
@@ -0,0 +1,31 @@
+package request
+
+import "time"
+
+// Clock is the source of time for a Limiter. It tells the Limiter what time it
+// is, and wakes it up when queued tasks are due to be released.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine once d has elapsed, unless the
+	// returned Timer is stopped first.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a pending call to a function scheduled with Clock.AfterFunc.
+type Timer interface {
+	// Stop prevents the function from being called. Returns false if the
+	// function has already been called or the timer already stopped.
+	Stop() bool
+}
+
+// realClock is the Clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
@@ -0,0 +1,90 @@
+package request
+
+import "context"
+
+// flight is a request in progress which every caller wanting the same
+// endpoint waits on, so that they share one slot of the Limiter's allowance
+// and one response.
+type flight struct {
+	//Closed once body and err are set
+	done chan struct{}
+	body []byte
+	err  error
+	//The number of callers still waiting, the priority of the most urgent
+	// caller to have waited, and the request most recently queued for them.
+	// Guarded by the Client's flightLock.
+	waiters  int
+	priority Priority
+	queued   *request
+	//Gives up on the request, once every caller has
+	cancel context.CancelFunc
+}
+
+// fetch requests the endpoint as fetchRetrying does, unless an identical
+// request is already queued or in flight, in which case its response is
+// waited for instead. The request is made on behalf of every caller waiting
+// on it, and is only given up on once all of them are done waiting. It is
+// queued with the priority of the most urgent caller to have waited on it, and
+// moves up to that priority's queue if such a caller joins while it is queued.
+func (c *Client) fetch(ctx context.Context, region, method, endpoint string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	priority := priorityFrom(ctx)
+	c.flightLock.Lock()
+	f, ok := c.flights[endpoint]
+	if !ok {
+		//The request outlives whoever made it for as long as others wait
+		flightCtx, cancel := context.WithCancel(context.Background())
+		f = &flight{
+			done:     make(chan struct{}),
+			priority: priority,
+			cancel:   cancel,
+		}
+		c.flights[endpoint] = f
+		go func() {
+			f.body, f.err = c.fetchRetrying(flightCtx, f, region, method, endpoint)
+			c.land(endpoint, f)
+			cancel()
+			close(f.done)
+		}()
+	}
+	f.waiters++
+	if priority < f.priority {
+		//Otherwise a more urgent caller would wait behind everything queued
+		// at the lower priority
+		f.priority = priority
+		if f.queued != nil {
+			c.lim.Reprioritize(f.queued, region, priority)
+		}
+	}
+	c.flightLock.Unlock()
+
+	select {
+	case <-f.done:
+		return f.body, f.err
+	case <-ctx.Done():
+		c.flightLock.Lock()
+		if f.waiters--; f.waiters == 0 {
+			//Later callers make the request afresh rather than waiting on
+			// one which is being given up on
+			f.cancel()
+			c.landLocked(endpoint, f)
+		}
+		c.flightLock.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// land stops identical requests waiting on f.
+func (c *Client) land(endpoint string, f *flight) {
+	c.flightLock.Lock()
+	c.landLocked(endpoint, f)
+	c.flightLock.Unlock()
+}
+
+func (c *Client) landLocked(endpoint string, f *flight) {
+	if c.flights[endpoint] == f {
+		delete(c.flights, endpoint)
+	}
+}
@@ -0,0 +1,145 @@
+package request_test
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	. "github.com/thomasmmitchell/recentlyplayedplus/request"
+	"github.com/thomasmmitchell/recentlyplayedplus/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Coalescing", func() {
+	api := withFakeAPI()
+
+	queued := func() int {
+		metrics, err := api.client.Limiter().Metrics()
+		Ω(err).ShouldNot(HaveOccurred())
+		total := 0
+		for _, depth := range metrics[0].QueueDepth {
+			total += depth
+		}
+		return total
+	}
+
+	lookUp := func(n int, ctx context.Context, id int64) []error {
+		errs := make([]error, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = api.client.GetRecentGamesContext(ctx, "na", id)
+			}(i)
+		}
+		wg.Wait()
+		return errs
+	}
+
+	It("should share one request among identical lookups in flight", func() {
+		api.server.SetLatency(200 * time.Millisecond)
+		for _, err := range lookUp(10, context.Background(), 42) {
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+		Ω(api.server.Hits()).Should(HaveLen(1))
+		metrics, err := api.client.Limiter().Metrics()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(metrics[0].Executed).Should(BeEquivalentTo(1))
+	})
+
+	It("should make the request again once the last one has finished", func() {
+		api.client.GetRecentGames("na", 42)
+		api.client.GetRecentGames("na", 42)
+		Ω(api.server.Hits()).Should(HaveLen(2))
+	})
+
+	It("should not share requests for different endpoints", func() {
+		api.server.SetLatency(100 * time.Millisecond)
+		var wg sync.WaitGroup
+		for _, id := range []int64{1, 2} {
+			wg.Add(1)
+			go func(id int64) {
+				defer wg.Done()
+				api.client.GetRecentGames("na", id)
+			}(id)
+		}
+		wg.Wait()
+		Ω(api.server.Hits()).Should(HaveLen(2))
+	})
+
+	It("should keep making the request for those still waiting when one gives up", func() {
+		api.server.SetLatency(300 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		var impatient error
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, impatient = api.client.GetRecentGamesContext(ctx, "na", 42)
+		}()
+		Eventually(api.server.Hits).Should(HaveLen(1))
+		_, err := api.client.GetRecentGames("na", 42)
+		Ω(err).ShouldNot(HaveOccurred())
+		<-done
+		Ω(impatient).Should(Equal(context.DeadlineExceeded))
+		Ω(api.server.Hits()).Should(HaveLen(1))
+	})
+
+	Context("When the region has no allowance left", func() {
+		BeforeEach(func() {
+			api.cfg.Rates = []types.Rate{{Period: 1, Max: 1}}
+		})
+
+		JustBeforeEach(func() {
+			_, err := api.client.GetRecentGames("na", 1)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("should queue identical lookups in one slot", func() {
+			done := make(chan []error)
+			go func() {
+				done <- lookUp(5, context.Background(), 42)
+			}()
+			Eventually(queued).Should(Equal(1))
+			Consistently(queued, "100ms").Should(Equal(1))
+			var errs []error
+			Eventually(done, "2s").Should(Receive(&errs))
+			for _, err := range errs {
+				Ω(err).ShouldNot(HaveOccurred())
+			}
+			Ω(api.server.Hits()).Should(HaveLen(2))
+		})
+
+		It("should move a queued lookup up to the priority of a more urgent caller joining it", func() {
+			background := WithPriority(context.Background(), PriorityBackground)
+			//A crawl fills the background queue, ending with the lookup to join
+			for id := int64(2); id <= 4; id++ {
+				go api.client.GetRecentGamesContext(background, "na", id)
+				Eventually(queued).Should(Equal(int(id - 1)))
+			}
+			interactive := WithPriority(context.Background(), PriorityInteractive)
+			_, err := api.client.GetRecentGamesContext(interactive, "na", 4)
+			Ω(err).ShouldNot(HaveOccurred())
+			hits := api.server.Hits()
+			Ω(hits).Should(HaveLen(2), "The joined lookup should go ahead of the rest of the crawl")
+			Ω(hits[1].Path).Should(HaveSuffix("/by-summoner/4"))
+			depth, err := api.client.Limiter().QueueDepth("na")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(depth[PriorityBackground]).Should(Equal(2))
+		})
+
+		It("should withdraw the request once everyone waiting gives up", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			for _, err := range lookUp(3, ctx, 42) {
+				Ω(err).Should(Equal(context.DeadlineExceeded))
+			}
+			Eventually(queued).Should(BeZero())
+			time.Sleep(time.Second)
+			Ω(api.server.Hits()).Should(HaveLen(1))
+		})
+	})
+})
@@ -0,0 +1,79 @@
+package request
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// DiskCache is a Cache which keeps each value in a file of its own in a
+// directory, so that values outlive this process and can be shared with others
+// using the same directory. Each file holds the time its value expires, in
+// Unix nanoseconds, on its first line, followed by the value.
+type DiskCache struct {
+	dir string
+}
+
+// NewDiskCache creates a DiskCache which keeps its values in dir, creating
+// the directory if it doesn't exist. Values already in dir are kept.
+func NewDiskCache(dir string) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DiskCache{dir: dir}, nil
+}
+
+// Get implements Cache. Files which can't be read are taken as missing, and
+// those whose TTL has passed are removed.
+func (c *DiskCache) Get(key string) ([]byte, bool) {
+	path := c.path(key)
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	newline := bytes.IndexByte(contents, '\n')
+	if newline < 0 {
+		return nil, false
+	}
+	expires, err := strconv.ParseInt(string(contents[:newline]), 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	if !time.Now().Before(time.Unix(0, expires)) {
+		os.Remove(path)
+		return nil, false
+	}
+	return contents[newline+1:], true
+}
+
+// Set implements Cache. The file is written under another name and then
+// renamed, so that it is never read part way through being written.
+func (c *DiskCache) Set(key string, value []byte, ttl time.Duration) error {
+	path := c.path(key)
+	tmp, err := ioutil.TempFile(c.dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	expires := strconv.FormatInt(time.Now().Add(ttl).UnixNano(), 10)
+	if _, err = tmp.Write(append([]byte(expires+"\n"), value...)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// path is the file a key's value is kept in. Keys are hashed, as they may
+// hold characters which aren't allowed in file names.
+func (c *DiskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
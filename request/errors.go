@@ -0,0 +1,138 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Sentinels which the errors of requests the API turned away match with
+// errors.Is, according to their status.
+var (
+	// ErrNotFound is matched by a 404 Not Found.
+	ErrNotFound = errors.New("Not found")
+	// ErrUnauthorized is matched by a 401 Unauthorized, which the API gives
+	// for a missing API key.
+	ErrUnauthorized = errors.New("Unauthorized API key")
+	// ErrForbidden is matched by a 403 Forbidden, which the API gives for an
+	// invalid or blacklisted API key.
+	ErrForbidden = errors.New("Forbidden")
+	// ErrRateLimited is matched by a 429 Too Many Requests, and by a
+	// RateLimitError.
+	ErrRateLimited = errors.New("Rate limited")
+	// ErrServiceUnavailable is matched by a 503 Service Unavailable.
+	ErrServiceUnavailable = errors.New("Service unavailable")
+)
+
+// statusSentinels maps each status with a sentinel to the sentinel.
+var statusSentinels = map[int]error{
+	http.StatusNotFound:           ErrNotFound,
+	http.StatusUnauthorized:       ErrUnauthorized,
+	http.StatusForbidden:          ErrForbidden,
+	http.StatusTooManyRequests:    ErrRateLimited,
+	http.StatusServiceUnavailable: ErrServiceUnavailable,
+}
+
+// maxErrorBody is the most of a response body an APIError keeps.
+const maxErrorBody = 512
+
+// APIError is returned when the API answers a request with a status other
+// than 2xx. Use errors.Is with the sentinels above to check for the common
+// ones, and errors.As to get at the details.
+type APIError struct {
+	//The status code and text, e.g. 404 and "404 Not Found"
+	StatusCode int
+	Status     string
+	//The region the request was made in
+	Region string
+	//The path requested, without the API key
+	Endpoint string
+	//How long the API asked us to wait before trying again. Zero if it
+	// didn't say.
+	RetryAfter time.Duration
+	//The start of the response body, for the API's explanation
+	Body string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("Request for '%s' in region '%s' returned '%s'", e.Endpoint, e.Region, e.Status)
+}
+
+// Is reports whether target is the sentinel for this error's status.
+func (e *APIError) Is(target error) bool {
+	sentinel, ok := statusSentinels[e.StatusCode]
+	return ok && sentinel == target
+}
+
+// RateLimitError is returned when the API has kept turning a request away for
+// exceeding the rate limits (HTTP 429), even after it was retried the maximum
+// number of times.
+type RateLimitError struct {
+	//The region the request was made in
+	Region string
+	//The number of times the request was sent
+	Attempts int
+	//How long the API last asked us to wait before trying again. Zero if it
+	// didn't say.
+	RetryAfter time.Duration
+	//The last 429 response the API gave to the request
+	Last *APIError
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("Request in region '%s' was rate limited %d times; giving up", e.Region, e.Attempts)
+}
+
+// Is reports whether target is ErrRateLimited.
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// Unwrap returns the APIError for the last response, so that errors.As can
+// find it.
+func (e *RateLimitError) Unwrap() error {
+	if e.Last == nil {
+		return nil
+	}
+	return e.Last
+}
+
+// redacted stands in for the API key in errors.
+const redacted = "[redacted]"
+
+// scrubbedError is an error whose message had the API key taken out of it.
+// Unwrap returns the original error, for errors.Is and errors.As.
+type scrubbedError struct {
+	err error
+	msg string
+}
+
+func (e *scrubbedError) Error() string {
+	return e.msg
+}
+
+func (e *scrubbedError) Unwrap() error {
+	return e.err
+}
+
+// scrub takes key out of the message of err. Errors which don't mention it
+// are returned as they are.
+func scrub(err error, key string) error {
+	if err == nil || key == "" || !strings.Contains(err.Error(), key) {
+		return err
+	}
+	return &scrubbedError{
+		err: err,
+		msg: scrubString(err.Error(), key),
+	}
+}
+
+// scrubString takes key out of s.
+func scrubString(s, key string) string {
+	if key == "" {
+		return s
+	}
+	return strings.Replace(s, key, redacted, -1)
+}
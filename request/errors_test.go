@@ -0,0 +1,153 @@
+package request_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	. "github.com/thomasmmitchell/recentlyplayedplus/request"
+	"github.com/thomasmmitchell/recentlyplayedplus/request/fakeriot"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("API errors", func() {
+	api := withFakeAPI()
+
+	BeforeEach(func() {
+		api.cfg.APIKey = "secret"
+		api.cfg.Retry.MaxAttempts = 1
+	})
+
+	It("should describe the response", func() {
+		api.server.Inject(fakeriot.Fault{Status: http.StatusServiceUnavailable, RetryAfter: 2 * time.Second})
+		_, err := api.client.GetRecentGames("na", 42)
+		var apiErr *APIError
+		Ω(errors.As(err, &apiErr)).Should(BeTrue())
+		Ω(apiErr.StatusCode).Should(Equal(http.StatusServiceUnavailable))
+		Ω(apiErr.Status).Should(Equal("503 Service Unavailable"))
+		Ω(apiErr.Region).Should(Equal("na"))
+		Ω(apiErr.Endpoint).Should(Equal("/api/lol/na/v1.3/game/by-summoner/42"))
+		Ω(apiErr.RetryAfter).Should(Equal(2 * time.Second))
+		Ω(apiErr.Body).Should(ContainSubstring("Service Unavailable"))
+		Ω(apiErr.Error()).ShouldNot(ContainSubstring("secret"))
+	})
+
+	sentinels := []struct {
+		status   int
+		sentinel error
+	}{
+		{http.StatusNotFound, ErrNotFound},
+		{http.StatusUnauthorized, ErrUnauthorized},
+		{http.StatusForbidden, ErrForbidden},
+		{http.StatusServiceUnavailable, ErrServiceUnavailable},
+	}
+	for _, s := range sentinels {
+		status, sentinel := s.status, s.sentinel
+		It("should match the sentinel for a "+http.StatusText(status), func() {
+			api.server.Inject(fakeriot.Fault{Status: status})
+			_, err := api.client.GetRecentGames("na", 42)
+			Ω(errors.Is(err, sentinel)).Should(BeTrue())
+			for _, other := range []error{ErrNotFound, ErrUnauthorized, ErrForbidden, ErrRateLimited, ErrServiceUnavailable} {
+				if other != sentinel {
+					Ω(errors.Is(err, other)).Should(BeFalse())
+				}
+			}
+		})
+	}
+
+	It("should match no sentinel for other statuses", func() {
+		api.server.Fail(1)
+		_, err := api.client.GetRecentGames("na", 42)
+		var apiErr *APIError
+		Ω(errors.As(err, &apiErr)).Should(BeTrue())
+		Ω(apiErr.StatusCode).Should(Equal(http.StatusInternalServerError))
+		Ω(errors.Is(err, ErrNotFound)).Should(BeFalse())
+	})
+
+	It("should match ErrRateLimited once it gives up on a request being rate limited", func() {
+		api.server.Throttle(10, 0)
+		_, err := api.client.GetRecentGames("na", 42)
+		Ω(errors.Is(err, ErrRateLimited)).Should(BeTrue())
+		var rateErr *RateLimitError
+		Ω(errors.As(err, &rateErr)).Should(BeTrue())
+	})
+
+	It("should still describe the last response once it gives up on a request being rate limited", func() {
+		api.server.Throttle(10, 0)
+		_, err := api.client.GetRecentGames("na", 42)
+		var apiErr *APIError
+		Ω(errors.As(err, &apiErr)).Should(BeTrue())
+		Ω(apiErr.StatusCode).Should(Equal(http.StatusTooManyRequests))
+		Ω(apiErr.Region).Should(Equal("na"))
+		Ω(apiErr.Endpoint).Should(Equal("/api/lol/na/v1.3/game/by-summoner/42"))
+	})
+
+	It("should not send the body of a failed response as well", func() {
+		api.server.Fail(1)
+		_, err := api.client.GetRecentGames("na", 42)
+		Ω(err).Should(HaveOccurred())
+		_, err = api.client.GetRecentGames("na", 42)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	Context("When keeping the API key secret", func() {
+		It("should send it in a header rather than the URL", func() {
+			_, err := api.client.GetRecentGames("na", 42)
+			Ω(err).ShouldNot(HaveOccurred())
+			hits := api.server.Hits()
+			Ω(hits).Should(HaveLen(1))
+			Ω(hits[0].APIKey).Should(Equal("secret"))
+			Ω(hits[0].Path).ShouldNot(ContainSubstring("secret"))
+		})
+
+		It("should take it out of errors from sending the request", func() {
+			api.client.SetHTTPClient(&http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					return nil, errors.New("proxy refused token " + r.Header.Get("X-Riot-Token"))
+				}),
+			})
+			_, err := api.client.GetRecentGames("na", 42)
+			Ω(err).Should(MatchError(ContainSubstring("proxy refused token [redacted]")))
+			Ω(err.Error()).ShouldNot(ContainSubstring("secret"))
+			var urlErr *url.Error
+			Ω(errors.As(err, &urlErr)).Should(BeTrue(), "The original error should still be there to inspect")
+		})
+
+		It("should take it out of response bodies kept by APIErrors", func() {
+			echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "key "+r.Header.Get("X-Riot-Token")+" is blacklisted", http.StatusForbidden)
+			}))
+			defer echo.Close()
+			api.client.SetBaseURL(echo.URL)
+			_, err := api.client.GetRecentGames("na", 42)
+			var apiErr *APIError
+			Ω(errors.As(err, &apiErr)).Should(BeTrue())
+			Ω(apiErr.Body).Should(ContainSubstring("key [redacted] is blacklisted"))
+		})
+
+		It("should keep it from redirects to another host", func() {
+			other := fakeriot.New()
+			defer other.Close()
+			api.server.Redirect(other.BaseURL() + "/api/lol/na/v1.3/game/by-summoner/42")
+			_, err := api.client.GetRecentGames("na", 42)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(api.server.Hits()[0].Status).Should(Equal(http.StatusFound))
+			hits := other.Hits()
+			Ω(hits).Should(HaveLen(1))
+			Ω(hits[0].APIKey).Should(BeEmpty())
+		})
+
+		It("should still send it on redirects to the same host", func() {
+			api.server.Redirect(api.server.BaseURL() + "/api/lol/na/v1.3/game/by-summoner/42")
+			_, err := api.client.GetRecentGames("na", 42)
+			Ω(err).ShouldNot(HaveOccurred())
+			hits := api.server.Hits()
+			Ω(hits).Should(HaveLen(2))
+			Ω(hits[1].APIKey).Should(Equal("secret"))
+		})
+	})
+})
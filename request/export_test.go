@@ -0,0 +1,32 @@
+package request
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// ParseRateHeader exposes parseRateHeader to tests.
+var ParseRateHeader = parseRateHeader
+
+// BackoffFor exposes RetryPolicy.backoff to tests.
+func BackoffFor(p RetryPolicy, attempts int, err error) time.Duration {
+	return p.backoff(attempts, err)
+}
+
+// ReconcileRates exposes reconcileRates to tests.
+func (c *Client) ReconcileRates(region, method string, header http.Header) {
+	c.reconcileRates(region, method, header)
+}
+
+// ResetDefaultClient undoes Init and UseRateStore, stopping the Client made by
+// Init, so that specs using the package functions don't depend on each other.
+func ResetDefaultClient() {
+	initLock.Lock()
+	defer initLock.Unlock()
+	if defaultClient != nil {
+		defaultClient.Stop(context.Background())
+		defaultClient = nil
+	}
+	defaultStore = nil
+}
@@ -0,0 +1,132 @@
+// Package fakeclock provides a request.Clock whose time only moves when it is
+// told to, so that Limiter tests can cover rate periods of minutes without
+// waiting on them.
+package fakeclock
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/thomasmmitchell/recentlyplayedplus/request"
+)
+
+// Clock is a request.Clock which stands still until Advance is called.
+type Clock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*timer
+	//Signalled whenever a timer is added, for BlockUntil
+	added *sync.Cond
+}
+
+type timer struct {
+	clock *Clock
+	at    time.Time
+	f     func()
+}
+
+// New creates a Clock which reads the given time until it is advanced.
+func New(now time.Time) *Clock {
+	ret := &Clock{now: now}
+	ret.added = sync.NewCond(&ret.lock)
+	return ret
+}
+
+// Now returns the time the clock has been advanced to.
+func (c *Clock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// AfterFunc schedules f to be called once the clock is advanced by at least d.
+func (c *Clock) AfterFunc(d time.Duration, f func()) request.Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t := &timer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	c.added.Broadcast()
+	return t
+}
+
+// Advance moves the clock forward by d. Timers that come due along the way are
+// fired in the order they are due, with the clock reading the time each is due
+// at when it is fired. As request.Clock requires, each timer's function is
+// called in its own goroutine, but Advance waits for it to return before moving
+// on. Timers may schedule further timers, which are fired too if they come due
+// before the clock reaches its new time.
+func (c *Clock) Advance(d time.Duration) {
+	c.lock.Lock()
+	target := c.now.Add(d)
+	for {
+		sort.SliceStable(c.timers, func(i, j int) bool {
+			return c.timers[i].at.Before(c.timers[j].at)
+		})
+		if len(c.timers) == 0 || c.timers[0].at.After(target) {
+			break
+		}
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		if t.at.After(c.now) {
+			c.now = t.at
+		}
+		c.lock.Unlock()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			t.f()
+		}()
+		<-done
+		c.lock.Lock()
+	}
+	c.now = target
+	c.lock.Unlock()
+}
+
+// Next returns the time at which the next timer is due, or false if there are
+// no timers waiting to be fired.
+func (c *Clock) Next() (time.Time, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.timers) == 0 {
+		return time.Time{}, false
+	}
+	next := c.timers[0].at
+	for _, t := range c.timers[1:] {
+		if t.at.Before(next) {
+			next = t.at
+		}
+	}
+	return next, true
+}
+
+// Timers returns the number of timers waiting to be fired.
+func (c *Clock) Timers() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.timers)
+}
+
+// BlockUntil waits until at least n timers are waiting to be fired. It is
+// useful for waiting on goroutines which are expected to schedule timers.
+func (c *Clock) BlockUntil(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for len(c.timers) < n {
+		c.added.Wait()
+	}
+}
+
+func (t *timer) Stop() bool {
+	c := t.clock
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, pending := range c.timers {
+		if pending == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package fakeclock_test
+
+import (
+	"time"
+
+	. "github.com/thomasmmitchell/recentlyplayedplus/request/fakeclock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Fakeclock", func() {
+	var clock *Clock
+	var start time.Time
+
+	BeforeEach(func() {
+		start = time.Date(2016, time.June, 1, 0, 0, 0, 0, time.UTC)
+		clock = New(start)
+	})
+
+	It("should stand still until advanced", func() {
+		Ω(clock.Now()).Should(Equal(start))
+		clock.Advance(10 * time.Minute)
+		Ω(clock.Now()).Should(Equal(start.Add(10 * time.Minute)))
+	})
+
+	It("should fire timers in order, at the time they are due", func() {
+		var fired []time.Time
+		clock.AfterFunc(2*time.Second, func() { fired = append(fired, clock.Now()) })
+		clock.AfterFunc(time.Second, func() { fired = append(fired, clock.Now()) })
+		clock.AfterFunc(time.Hour, func() { fired = append(fired, clock.Now()) })
+		Ω(clock.Timers()).Should(Equal(3))
+		clock.Advance(time.Minute)
+		Ω(fired).Should(Equal([]time.Time{start.Add(time.Second), start.Add(2 * time.Second)}))
+		Ω(clock.Timers()).Should(Equal(1))
+	})
+
+	It("should fire timers scheduled by timers when they come due", func() {
+		fired := 0
+		clock.AfterFunc(time.Second, func() {
+			clock.AfterFunc(time.Second, func() { fired++ })
+		})
+		clock.Advance(2 * time.Second)
+		Ω(fired).Should(Equal(1))
+	})
+
+	It("should wait for fired timers to return before moving on", func() {
+		returned := false
+		clock.AfterFunc(time.Second, func() {
+			time.Sleep(50 * time.Millisecond)
+			returned = true
+		})
+		clock.Advance(time.Second)
+		Ω(returned).Should(BeTrue())
+	})
+
+	It("should not fire stopped timers", func() {
+		fired := false
+		timer := clock.AfterFunc(time.Second, func() { fired = true })
+		Ω(timer.Stop()).Should(BeTrue())
+		Ω(timer.Stop()).Should(BeFalse())
+		clock.Advance(time.Minute)
+		Ω(fired).Should(BeFalse())
+	})
+
+	It("should report when the next timer is due", func() {
+		_, ok := clock.Next()
+		Ω(ok).Should(BeFalse())
+		clock.AfterFunc(time.Minute, func() {})
+		clock.AfterFunc(time.Second, func() {})
+		next, ok := clock.Next()
+		Ω(ok).Should(BeTrue())
+		Ω(next).Should(Equal(start.Add(time.Second)))
+	})
+})
@@ -0,0 +1,374 @@
+// Package fakeriot provides a fake of the Riot API, served locally with
+// httptest, so that requests can be tested end to end without the live API.
+// It serves summoner and recent game fixtures for each region, can be told to
+// turn requests away, redirect them or answer them slowly, can report rate
+// limits in the headers of its responses as the API does, and records when
+// each request arrived so that tests can check the rates traffic was held to.
+package fakeriot
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thomasmmitchell/recentlyplayedplus/types"
+)
+
+// Server is a fake of the Riot API. Point a request.Client at it with
+// BaseURL. Server is safe for concurrent use.
+type Server struct {
+	server *httptest.Server
+	lock   sync.Mutex
+	//Keyed by region, then by normalised summoner name
+	summoners map[string]map[string]types.Summoner
+	//Keyed by region, then by summoner ID
+	games map[string]map[int64]types.Matchlist
+	//Faults still to be injected, in the order they were added
+	faults  []Fault
+	latency time.Duration
+	hits    []Hit
+	//Reported in the rate limit headers of every response, if set
+	rateLimits       []types.Rate
+	methodRateLimits map[string][]types.Rate
+}
+
+// Fault is a response to be given in place of the one a request would get.
+type Fault struct {
+	//The status to respond with. Zero to respond as usual, after Delay.
+	Status int
+	//Sent as the Retry-After header in whole seconds, as for a 429 or 503.
+	// Zero to leave the header out.
+	RetryAfter time.Duration
+	//Sent as the Location header, as for a redirect. Empty to leave the
+	// header out.
+	Location string
+	//How long to wait before responding
+	Delay time.Duration
+	//The number of requests to give this response to. Zero is taken as one.
+	Times int
+}
+
+// Hit records a request which reached the server.
+type Hit struct {
+	At     time.Time
+	Region string
+	//"summoner" or "game", or "" for a path the server doesn't know
+	Method string
+	Path   string
+	APIKey string
+	//The status the request was answered with
+	Status int
+}
+
+// New starts a Server with no fixtures. Close it once it is no longer needed.
+func New() *Server {
+	s := &Server{
+		summoners:        make(map[string]map[string]types.Summoner),
+		games:            make(map[string]map[int64]types.Matchlist),
+		methodRateLimits: make(map[string][]types.Rate),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Close shuts the server down, waiting for requests in progress to finish.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// BaseURL is the base URL to send requests for every region to, as taken by
+// request.Client.SetBaseURL or config.HTTP.BaseURL.
+func (s *Server) BaseURL() string {
+	return s.server.URL
+}
+
+// AddSummoner serves summoner to lookups of its name in region.
+func (s *Server) AddSummoner(region string, summoner types.Summoner) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.summoners[region] == nil {
+		s.summoners[region] = make(map[string]types.Summoner)
+	}
+	s.summoners[region][Normalize(summoner.Name)] = summoner
+}
+
+// AddRecentGames serves games to recent game lookups of the summoner whose ID
+// is games.SummonerID in region.
+func (s *Server) AddRecentGames(region string, games types.Matchlist) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.games[region] == nil {
+		s.games[region] = make(map[int64]types.Matchlist)
+	}
+	s.games[region][int64(games.SummonerID)] = games
+}
+
+// Inject has the next requests which reach the server get fault in place of
+// their usual response. Faults are given in the order they were injected.
+func (s *Server) Inject(fault Fault) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if fault.Times <= 0 {
+		fault.Times = 1
+	}
+	s.faults = append(s.faults, fault)
+}
+
+// Throttle has the next times requests turned away with a 429, asking for
+// retryAfter to pass before the next request.
+func (s *Server) Throttle(times int, retryAfter time.Duration) {
+	s.Inject(Fault{Status: http.StatusTooManyRequests, RetryAfter: retryAfter, Times: times})
+}
+
+// Redirect has the next request answered with a 302 to location.
+func (s *Server) Redirect(location string) {
+	s.Inject(Fault{Status: http.StatusFound, Location: location})
+}
+
+// Fail has the next times requests answered with a 500.
+func (s *Server) Fail(times int) {
+	s.Inject(Fault{Status: http.StatusInternalServerError, Times: times})
+}
+
+// SetLatency has every response wait for d before being sent, on top of any
+// injected Delay.
+func (s *Server) SetLatency(d time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.latency = d
+}
+
+// SetRateLimits has every response report rates as the rate limits of the API
+// key, in the X-App-Rate-Limit header, and how many requests to the same
+// region reached the server within the period of each, in the
+// X-App-Rate-Limit-Count header. The server doesn't hold requests to them.
+func (s *Server) SetRateLimits(rates ...types.Rate) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rateLimits = rates
+}
+
+// SetMethodRateLimits is SetRateLimits for the rate limits of method
+// ("summoner" or "game"), reported in the X-Method-Rate-Limit and
+// X-Method-Rate-Limit-Count headers of responses to requests for it.
+func (s *Server) SetMethodRateLimits(method string, rates ...types.Rate) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.methodRateLimits[method] = rates
+}
+
+// Hits returns every request which has reached the server, in the order they
+// arrived.
+func (s *Server) Hits() []Hit {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Hit(nil), s.hits...)
+}
+
+// HitsPerSecond counts the requests which reached the server in each second
+// since the first of them.
+func (s *Server) HitsPerSecond() []int {
+	hits := s.Hits()
+	if len(hits) == 0 {
+		return nil
+	}
+	var ret []int
+	for _, hit := range hits {
+		second := int(hit.At.Sub(hits[0].At) / time.Second)
+		for len(ret) <= second {
+			ret = append(ret, 0)
+		}
+		ret[second]++
+	}
+	return ret
+}
+
+// PeakHits is the most requests which reached the server within any window of
+// the given length.
+func (s *Server) PeakHits(window time.Duration) int {
+	hits := s.Hits()
+	peak, first := 0, 0
+	for last := range hits {
+		for hits[last].At.Sub(hits[first].At) >= window {
+			first++
+		}
+		if n := last - first + 1; n > peak {
+			peak = n
+		}
+	}
+	return peak
+}
+
+// WithinRate is true if no more than rate.Max requests reached the server
+// within any rate.Period seconds.
+func (s *Server) WithinRate(rate types.Rate) bool {
+	return s.PeakHits(time.Duration(rate.Period)*time.Second) <= int(rate.Max)
+}
+
+// MaxSummonerNames is the most names the server looks up in one request, as
+// with the API. Requests for more are answered with a 400.
+const MaxSummonerNames = 40
+
+// Normalize returns the form of a summoner name which the API keys lookups by,
+// lower case with spaces removed.
+func Normalize(name string) string {
+	return strings.ToLower(strings.Replace(name, " ", "", -1))
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	hit := Hit{
+		At:     time.Now(),
+		Path:   r.URL.Path,
+		APIKey: r.Header.Get("X-Riot-Token"),
+	}
+	//Paths are /api/lol/{region}/{version}/{method}/..., with each part escaped
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	if len(parts) >= 5 && parts[0] == "api" && parts[1] == "lol" {
+		hit.Region = parts[2]
+		hit.Method = parts[4]
+	}
+	s.lock.Lock()
+	fault := s.nextFault()
+	delay := s.latency + fault.Delay
+	status, body := fault.Status, []byte(nil)
+	if status == 0 {
+		status, body = s.respond(hit.Region, hit.Method, parts)
+	}
+	hit.Status = status
+	s.hits = append(s.hits, hit)
+	header := w.Header()
+	if len(s.rateLimits) > 0 {
+		header.Set("X-App-Rate-Limit", formatRates(s.rateLimits))
+		header.Set("X-App-Rate-Limit-Count", s.formatCounts(s.rateLimits, hit, false))
+	}
+	if rates := s.methodRateLimits[hit.Method]; len(rates) > 0 {
+		header.Set("X-Method-Rate-Limit", formatRates(rates))
+		header.Set("X-Method-Rate-Limit-Count", s.formatCounts(rates, hit, true))
+	}
+	s.lock.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if fault.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(fault.RetryAfter/time.Second)))
+	}
+	if fault.Location != "" {
+		w.Header().Set("Location", fault.Location)
+	}
+	if body == nil {
+		//The API explains errors in a JSON body too
+		w.Header().Set("Content-Type", "application/json;charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"status": {"message": %q, "status_code": %d}}`, http.StatusText(status), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// nextFault takes the next injected fault, if any, off the queue. Must be
+// called with the lock held.
+func (s *Server) nextFault() Fault {
+	if len(s.faults) == 0 {
+		return Fault{}
+	}
+	ret := s.faults[0]
+	if s.faults[0].Times--; s.faults[0].Times <= 0 {
+		s.faults = s.faults[1:]
+	}
+	return ret
+}
+
+// formatRates writes rates as the value of a rate limit header, a comma
+// separated list of "max:period" pairs.
+func formatRates(rates []types.Rate) string {
+	pairs := make([]string, len(rates))
+	for i, rate := range rates {
+		pairs[i] = fmt.Sprintf("%d:%d", rate.Max, rate.Period)
+	}
+	return strings.Join(pairs, ",")
+}
+
+// formatCounts writes the number of requests which reached the server within
+// the period of each of rates, up to and including hit, as the value of a rate
+// count header. Only requests to the region of hit are counted, and if
+// sameMethod is set, only those for its method too. Must be called with the
+// lock held.
+func (s *Server) formatCounts(rates []types.Rate, hit Hit, sameMethod bool) string {
+	pairs := make([]string, len(rates))
+	for i, rate := range rates {
+		since := hit.At.Add(-time.Duration(rate.Period) * time.Second)
+		count := 0
+		for _, other := range s.hits {
+			if other.Region == hit.Region && other.At.After(since) && (!sameMethod || other.Method == hit.Method) {
+				count++
+			}
+		}
+		pairs[i] = fmt.Sprintf("%d:%d", count, rate.Period)
+	}
+	return strings.Join(pairs, ",")
+}
+
+// respond serves the fixtures asked for by a request. Must be called with the
+// lock held.
+func (s *Server) respond(region, method string, parts []string) (int, []byte) {
+	switch {
+	case method == "summoner" && len(parts) == 7 && parts[5] == "by-name":
+		names := strings.Split(parts[6], ",")
+		if len(names) > MaxSummonerNames {
+			return http.StatusBadRequest, nil
+		}
+		found := make(map[string]summoner)
+		for _, name := range names {
+			name, err := url.PathUnescape(name)
+			if err != nil {
+				return http.StatusBadRequest, nil
+			}
+			if match, ok := s.summoners[region][Normalize(name)]; ok {
+				found[Normalize(name)] = summoner{ID: match.ID, Name: match.Name}
+			}
+		}
+		if len(found) == 0 {
+			return http.StatusNotFound, nil
+		}
+		return marshal(found)
+	case method == "game" && len(parts) == 7 && parts[5] == "by-summoner":
+		id, err := strconv.ParseInt(parts[6], 10, 64)
+		if err != nil {
+			return http.StatusBadRequest, nil
+		}
+		games, ok := s.games[region][id]
+		if !ok {
+			//The API has an empty history for summoners without games
+			games = types.Matchlist{SummonerID: int(id)}
+		}
+		return marshal(games)
+	}
+	return http.StatusNotFound, nil
+}
+
+// summoner is a summoner as the API describes it.
+type summoner struct {
+	ID   uint64 `json:"id"`
+	Name string `json:"name"`
+}
+
+func marshal(v interface{}) (int, []byte) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return http.StatusInternalServerError, nil
+	}
+	return http.StatusOK, body
+}
@@ -0,0 +1,13 @@
+package fakeriot_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestFakeriot(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Fakeriot Suite")
+}
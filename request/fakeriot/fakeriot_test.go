@@ -0,0 +1,197 @@
+package fakeriot_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/thomasmmitchell/recentlyplayedplus/config"
+	"github.com/thomasmmitchell/recentlyplayedplus/request"
+	. "github.com/thomasmmitchell/recentlyplayedplus/request/fakeriot"
+	"github.com/thomasmmitchell/recentlyplayedplus/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Fakeriot", func() {
+	var server *Server
+	var client *request.Client
+	var cfg *config.Config
+
+	JustBeforeEach(func() {
+		var err error
+		client, err = request.NewClient(cfg)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	BeforeEach(func() {
+		server = New()
+		server.AddSummoner("na", types.Summoner{Name: "Some One", ID: 42})
+		games := types.Matchlist{}
+		Ω(json.Unmarshal([]byte(`{"summonerId": 42, "games": [{"gameId": 7, "gameMode": "CLASSIC"}]}`), &games)).Should(Succeed())
+		server.AddRecentGames("na", games)
+		cfg = &config.Config{
+			APIKey:  "key",
+			Regions: []string{"na", "euw"},
+			HTTP:    config.HTTP{BaseURL: server.BaseURL()},
+		}
+	})
+
+	AfterEach(func() {
+		client.Stop(context.Background())
+		server.Close()
+	})
+
+	//Sends a request straight to the server, bypassing the client
+	send := func(path string) *http.Response {
+		resp, err := http.Get(server.BaseURL() + path)
+		Ω(err).ShouldNot(HaveOccurred())
+		return resp
+	}
+
+	Context("When serving fixtures", func() {
+		It("should serve summoners by their normalised name", func() {
+			resp := send("/api/lol/na/v1.4/summoner/by-name/SOMEONE")
+			defer resp.Body.Close()
+			Ω(resp.StatusCode).Should(Equal(http.StatusOK))
+			found := make(map[string]types.Summoner)
+			Ω(json.NewDecoder(resp.Body).Decode(&found)).Should(Succeed())
+			Ω(found).Should(Equal(map[string]types.Summoner{
+				"someone": {Name: "Some One", ID: 42},
+			}))
+		})
+
+		It("should serve recent games by summoner ID", func() {
+			games, err := client.GetRecentGames("na", 42)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(games.SummonerID).Should(Equal(42))
+			Ω(games.Games).Should(HaveLen(1))
+			Ω(games.Games[0].GameID).Should(Equal(7))
+		})
+
+		It("should keep each region's fixtures to itself", func() {
+			resp := send("/api/lol/euw/v1.4/summoner/by-name/someone")
+			resp.Body.Close()
+			Ω(resp.StatusCode).Should(Equal(http.StatusNotFound))
+			games, err := client.GetRecentGames("euw", 42)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(games.Games).Should(BeEmpty())
+		})
+
+		It("should record each request", func() {
+			client.GetSummoners("na", "Some One")
+			client.GetRecentGames("euw", 42)
+			hits := server.Hits()
+			Ω(hits).Should(HaveLen(2))
+			Ω(hits[0].Region).Should(Equal("na"))
+			Ω(hits[0].Method).Should(Equal("summoner"))
+			Ω(hits[0].APIKey).Should(Equal("key"))
+			Ω(hits[0].Status).Should(Equal(http.StatusOK))
+			Ω(hits[1].Region).Should(Equal("euw"))
+			Ω(hits[1].Method).Should(Equal("game"))
+		})
+	})
+
+	Context("When injecting faults", func() {
+		BeforeEach(func() {
+			cfg.Retry = config.Retry{MaxAttempts: 1}
+		})
+
+		It("should fail requests", func() {
+			server.Fail(1)
+			resp := send("/api/lol/na/v1.4/summoner/by-name/someone")
+			resp.Body.Close()
+			Ω(resp.StatusCode).Should(Equal(http.StatusInternalServerError))
+			resp = send("/api/lol/na/v1.4/summoner/by-name/someone")
+			resp.Body.Close()
+			Ω(resp.StatusCode).Should(Equal(http.StatusOK), "Only the one request should fail")
+		})
+
+		It("should throttle requests until the time it asked for", func() {
+			server.Throttle(1, time.Second)
+			games, err := client.GetRecentGames("na", 42)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(games.SummonerID).Should(Equal(42))
+			hits := server.Hits()
+			Ω(hits).Should(HaveLen(2))
+			Ω(hits[0].Status).Should(Equal(http.StatusTooManyRequests))
+			Ω(hits[1].At.Sub(hits[0].At)).Should(BeNumerically(">=", time.Second))
+		})
+
+		Context("With a client timeout", func() {
+			BeforeEach(func() {
+				cfg.HTTP.Timeout = 50 * time.Millisecond
+			})
+
+			It("should answer slowly", func() {
+				server.Inject(Fault{Delay: time.Second})
+				start := time.Now()
+				_, _, err := client.GetSummoners("na", "Some One")
+				Ω(err).Should(HaveOccurred())
+				Ω(time.Since(start)).Should(BeNumerically("<", time.Second))
+				_, _, err = client.GetSummoners("na", "Some One")
+				Ω(err).ShouldNot(HaveOccurred(), "Only the one request should be slow")
+			})
+		})
+	})
+
+	Context("When reporting rate limits", func() {
+		get := func(path string) http.Header {
+			resp, err := http.Get(server.BaseURL() + path)
+			Ω(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+			return resp.Header
+		}
+
+		BeforeEach(func() {
+			server.SetRateLimits(types.Rate{Period: 1, Max: 20}, types.Rate{Period: 120, Max: 100})
+			server.SetMethodRateLimits("game", types.Rate{Period: 10, Max: 5})
+		})
+
+		It("should report the limits and how many requests each has counted", func() {
+			get("/api/lol/na/v1.3/game/by-summoner/42")
+			get("/api/lol/euw/v1.3/game/by-summoner/42")
+			header := get("/api/lol/na/v1.3/game/by-summoner/42")
+			Ω(header.Get("X-App-Rate-Limit")).Should(Equal("20:1,100:120"))
+			Ω(header.Get("X-App-Rate-Limit-Count")).Should(Equal("2:1,2:120"), "Only requests to the same region should count")
+			Ω(header.Get("X-Method-Rate-Limit")).Should(Equal("5:10"))
+			Ω(header.Get("X-Method-Rate-Limit-Count")).Should(Equal("2:10"))
+		})
+
+		It("should only report the limits of the method requested", func() {
+			get("/api/lol/na/v1.3/game/by-summoner/42")
+			header := get("/api/lol/na/v1.4/summoner/by-name/someone")
+			Ω(header.Get("X-App-Rate-Limit-Count")).Should(Equal("2:1,2:120"))
+			Ω(header.Get("X-Method-Rate-Limit")).Should(BeEmpty())
+			Ω(header.Get("X-Method-Rate-Limit-Count")).Should(BeEmpty())
+		})
+	})
+
+	Context("When the client is rate limited", func() {
+		rate := types.Rate{Period: 1, Max: 3}
+
+		BeforeEach(func() {
+			cfg.Rates = []types.Rate{rate}
+		})
+
+		It("should never receive more requests than the rate allows", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 9; i++ {
+				wg.Add(1)
+				go func(id int64) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					_, err := client.GetRecentGames("na", id)
+					Ω(err).ShouldNot(HaveOccurred())
+				}(int64(i))
+			}
+			wg.Wait()
+			Ω(server.Hits()).Should(HaveLen(9))
+			Ω(server.WithinRate(rate)).Should(BeTrue(), "Hits per second: %v", server.HitsPerSecond())
+			Ω(server.PeakHits(time.Second)).Should(Equal(3))
+		})
+	})
+})
@@ -1,68 +1,174 @@
 package request
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
-
-	"github.com/hishboy/gocommons/lang"
 )
 
 // Limiter restricts the rate at which incoming LimitedDoer objects can perform
 // their tasks. The rates to which limits are held can be split into distinct
 // regions (as opposed to holding many limiters).
+// Rather than checking for allowance at fixed intervals, the Limiter works out
+// the exact instant at which the next queued task will be allowed by every rate
+// it is held to, and releases it then.
 type Limiter struct {
-	regions      map[string]*region
-	clock        uint32
-	secondTicker *time.Ticker
-	lock         sync.Mutex
-	isStopped    bool
+	regions map[string]*region
+	clock   Clock
+	//Counts the requests made against the rates of every region
+	store RateStore
+	//Fires when the next queued task is due to be released. nil if no queued
+	// task has a known release time.
+	wakeTimer Timer
+	lock      sync.Mutex
+	isStopped bool
+	//Set once Stop has been called, while queued tasks may still be draining
+	isStopping bool
+	//Closed once the limiter has nothing queued or running, while draining
+	drained chan struct{}
+	policy  DequeuePolicy
+	//Where the RateStore is persisted to, if anywhere. See PersistTo.
+	snapshotPath  string
+	snapshotEvery time.Duration
+	snapshotTimer Timer
 }
 
 type region struct {
-	rates []*rate
-	//outstanding requests for this region
-	//TODO: This queue is synchronized. It doesn't need to be because sync
-	// is handled at the limiter level (because of the clock). So, I'll switch
-	// this out when I have time to implement my own non-thread-safe queue.
-	tasks         *lang.Queue
-	hasZeroPeriod bool
-}
-
-type rate struct {
-	// An array of seconds, with values representing the number of requests made
-	// in that second
-	history []uint32
-	// The number of requests that occurred in this second
-	thisTick uint32
-	// The remaining number of requests that can occur given time period.
-	allowance uint32
-	// Number of seconds within which the max requests can occur
-	period uint32
-}
-
-// NewLimiter creates a Limiter object with its ticker running, and ultimately
-// ready to be used with the remainder of the Limiter member functions.
+	name  string
+	rates rateSet
+	//The method buckets of this region, keyed by name. Tasks enqueued without
+	// a method are kept in the bucket named "".
+	methods map[string]*method
+	//No tasks are released for this region before this time
+	frozenUntil time.Time
+	//The number of released tasks of this region which haven't completed yet
+	running int
+	//The most tasks that may be running at once. Zero means there is no cap.
+	maxInFlight int
+	//Running tally for WeightedFair across the method buckets of the region
+	credit [numPriorities]int
+	//What the region has done with the tasks enqueued for it, for Metrics
+	executed  uint64
+	rejected  uint64
+	throttled uint64
+	wait      *histogram
+}
+
+// method is a bucket of requests within a region which is held to its own
+// rates, on top of the rates of the region.
+type method struct {
+	rates rateSet
+	//outstanding requests for this method of the region
+	tasks *lanes
+}
+
+// NewLimiter creates a Limiter object ready to be used with the remainder of
+// the Limiter member functions.
 func NewLimiter() *Limiter {
-	ret := &Limiter{
-		regions:      make(map[string]*region),
-		secondTicker: time.NewTicker(1 * time.Second),
-		isStopped:    false,
+	return NewLimiterWithClock(realClock{})
+}
+
+// NewLimiterWithClock creates a Limiter object like NewLimiter, which keeps
+// time with the given Clock rather than the system clock.
+func NewLimiterWithClock(clock Clock) *Limiter {
+	return NewLimiterWithStore(NewMemoryStore(), clock)
+}
+
+// NewLimiterWithStore creates a Limiter object like NewLimiterWithClock, which
+// counts requests against its rates in the given RateStore rather than in its
+// own memory. Limiters in different processes which share a store, and which
+// have the same rates for a region, share one budget for that region.
+func NewLimiterWithStore(store RateStore, clock Clock) *Limiter {
+	return &Limiter{
+		regions:   make(map[string]*region),
+		clock:     clock,
+		store:     store,
+		isStopped: false,
+	}
+}
+
+// storeRetryDelay is how long to wait before trying the RateStore again after
+// it errs.
+const storeRetryDelay = time.Second
+
+// ErrLimiterStopped is returned by a Limiter which has been stopped, and given
+// to queued tasks that it rejects because of it.
+var ErrLimiterStopped = errors.New("Limiter has been stopped")
+
+// RejectableDoer is a LimitedDoer which can be told that it will never be
+// performed. A Limiter which is stopped while the task is queued calls Reject
+// with ErrLimiterStopped in place of Do. Tasks which are not RejectableDoers
+// are dropped in that case without being performed, as performing them would
+// disregard the rates, so nothing should be left waiting on them forever.
+type RejectableDoer interface {
+	LimitedDoer
+	Reject(err error)
+}
+
+// rejectAll tells every RejectableDoer among tasks that it will never be
+// performed. The rest are dropped. Must be called without the lock held.
+func rejectAll(tasks []LimitedDoer, err error) {
+	for _, task := range tasks {
+		if rd, ok := task.(RejectableDoer); ok {
+			rd.Reject(err)
+		}
 	}
-	go ret.asyncUpdate()
-	return ret
 }
 
-// Stop signals the halting of the ticker of the Limiter object and
-// causes the Limiter to err on enqueues made after the ticker is successfully
-// stopped . This function should be called to allow the Limiter object to be
-// garbage collected. No guarantees are made that no enqueues will be admitted
-// or processed between the calling of this function and the stopping of the
-// ticker, but currently blocked requests will not be performed.
-func (l *Limiter) Stop() {
+// StopMode decides what a Limiter does with its queued tasks when stopped.
+type StopMode int
+
+const (
+	// RejectQueued rejects every queued task straight away.
+	RejectQueued StopMode = iota
+	// DrainQueued keeps performing queued tasks, within the rate limits, until
+	// none are left and every released task has completed. Whatever is still
+	// queued once the context given to Stop is done is rejected.
+	DrainQueued
+)
+
+// Stop halts the Limiter object, causing it to err on enqueues made from now
+// on, and deals with the tasks still queued according to mode. Blocks until
+// the Limiter has stopped. Returns ctx.Err() if ctx was done before queued
+// tasks could be drained, or the error saving the final snapshot of a Limiter
+// given to PersistTo, and nil otherwise. Tasks which have already been
+// released will still be performed. Queued tasks which can't be rejected are
+// dropped; see RejectableDoer. This function should be called to allow the
+// Limiter object to be garbage collected.
+func (l *Limiter) Stop(ctx context.Context, mode StopMode) error {
 	l.lock.Lock()
+	l.isStopping = true
+	var err error
+	if mode == DrainQueued && !l.isStopped && !l.idle() {
+		if l.drained == nil {
+			l.drained = make(chan struct{})
+		}
+		drained := l.drained
+		l.lock.Unlock()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		l.lock.Lock()
+	}
 	l.isStopped = true
+	if l.wakeTimer != nil {
+		l.wakeTimer.Stop()
+		l.wakeTimer = nil
+	}
+	var rejected []LimitedDoer
+	for _, r := range l.regions {
+		rejected = append(rejected, r.dropQueued()...)
+	}
 	l.lock.Unlock()
+	rejectAll(rejected, ErrLimiterStopped)
+	if serr := l.finalSnapshot(); err == nil {
+		err = serr
+	}
+	return err
 }
 
 // AddRegion registers with this limiter object a new region with the called
@@ -71,17 +177,22 @@ func (l *Limiter) Stop() {
 func (l *Limiter) AddRegion(name string) error {
 	l.lock.Lock()
 	defer l.lock.Unlock()
-	if l.isStopped {
-		return fmt.Errorf("Limiter has been stopped")
+	if l.isStopping {
+		return ErrLimiterStopped
 	}
+	return l.addRegion(name)
+}
+
+func (l *Limiter) addRegion(name string) error {
 	_, alreadyExists := l.regions[name]
 	if alreadyExists {
 		return fmt.Errorf("Region %s already exists!", name)
 	}
 	l.regions[name] = &region{
-		tasks:         lang.NewQueue(),
-		rates:         nil,
-		hasZeroPeriod: false,
+		name:    name,
+		rates:   rateSet{key: name},
+		methods: make(map[string]*method),
+		wait:    newHistogram(waitBuckets),
 	}
 	return nil
 }
@@ -92,27 +203,90 @@ func (l *Limiter) AddRegion(name string) error {
 // This errs if the region specified doesn't exist in the limiter, or if the
 // limiter has been stopped. Adding a rate with a period of zero will create
 // a rate which never has its allowance replenish - calls to Enqueue after this
-// point will return an error.
+// point will return an error. Requests already counted against the region's
+// other rates are counted against the new rate too, where they fall within its
+// period.
 func (l *Limiter) AddRate(limit, period uint32, region string) error {
 	l.lock.Lock()
 	defer l.lock.Unlock()
-	if l.isStopped {
-		return fmt.Errorf("Limiter has been stopped")
+	if l.isStopping {
+		return ErrLimiterStopped
 	}
 	reg, ok := l.regions[region]
 	if !ok {
 		return fmt.Errorf("Cannot add rate for unknown region '%s'", region)
 	}
-	reg.rates = append(reg.rates, &rate{
-		history:   make([]uint32, period, period),
-		thisTick:  0,
-		allowance: limit,
-		period:    period,
-	})
-	if period == 0 {
-		reg.hasZeroPeriod = true
+	err := reg.rates.add(limit, period, l.store, l.clock.Now())
+	l.update()
+	return err
+}
+
+// AddMethodRate registers a new rate with the given method of the region
+// specified within this limiter. A task enqueued for a method will only be
+// performed once there is remaining allowance within EVERY rate of the method,
+// as well as every rate of the region. The method is created if it doesn't
+// already exist. Otherwise behaves as AddRate.
+func (l *Limiter) AddMethodRate(limit, period uint32, region, method string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.isStopping {
+		return ErrLimiterStopped
 	}
-	return nil
+	reg, ok := l.regions[region]
+	if !ok {
+		return fmt.Errorf("Cannot add rate for unknown region '%s'", region)
+	}
+	err := reg.method(method).rates.add(limit, period, l.store, l.clock.Now())
+	l.update()
+	return err
+}
+
+// Reconcile brings the rates of the given region in line with what the server
+// reports about them. Both maps are keyed by a rate's period in seconds: limits
+// holds the maximum number of requests allowed within each period, and counts
+// holds the number of requests the server has counted within each period.
+// Reconciling only ever makes the Limiter more conservative:
+//
+//   - A limit for a period with no rate in the region adds that rate.
+//   - A limit lower than the configured max of a rate lowers the max.
+//   - A count higher than the Limiter's own count for a rate uses up the
+//     difference in allowance, which is returned once the period elapses.
+//
+// Counts for periods with no rate and no reported limit are ignored, as are
+// periods of zero. The limits reported are remembered, and go on holding when
+// the rates are updated by UpdateRates or Configure. Errs if the region doesn't exist or if the Limiter has been
+// stopped.
+func (l *Limiter) Reconcile(region string, limits, counts map[uint32]uint32) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.isStopped {
+		return ErrLimiterStopped
+	}
+	reg, ok := l.regions[region]
+	if !ok {
+		return fmt.Errorf("Cannot reconcile unknown region '%s'", region)
+	}
+	err := reg.rates.reconcile(limits, counts, l.store, l.clock.Now())
+	l.update()
+	return err
+}
+
+// ReconcileMethod is Reconcile for the rates of a method of the given region,
+// rather than the rates of the region itself. The method is created if it
+// doesn't already exist.
+func (l *Limiter) ReconcileMethod(region, method string, limits, counts map[uint32]uint32) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.isStopped {
+		return ErrLimiterStopped
+	}
+	reg, ok := l.regions[region]
+	if !ok {
+		return fmt.Errorf("Cannot reconcile unknown region '%s'", region)
+	}
+	err := reg.method(method).rates.reconcile(limits, counts, l.store, l.clock.Now())
+	l.update()
+	return err
 }
 
 // Enqueue registers a LimitedDoer with the Limiter to be executed at a later
@@ -123,100 +297,440 @@ func (l *Limiter) AddRate(limit, period uint32, region string) error {
 // current task has been queued for later execution.
 // Errs if the given region doesn't exist or if the Limiter has been stopped.
 func (l *Limiter) Enqueue(task LimitedDoer, region string) (uint32, error) {
+	return l.EnqueueMethod(task, region, "")
+}
+
+// EnqueueMethod is Enqueue for a task which is also held to the rates of the
+// given method of the region. A method with no rates added only has to obey the
+// rates of the region.
+func (l *Limiter) EnqueueMethod(task LimitedDoer, region, method string) (uint32, error) {
+	return l.EnqueuePriority(task, region, method, PriorityNormal)
+}
+
+// EnqueuePriority is EnqueueMethod for a task with the given priority. When
+// there isn't allowance for every queued task of a method, the Limiter's
+// DequeuePolicy decides which priority goes first. Tasks enqueued by Enqueue
+// and EnqueueMethod have PriorityNormal. Additionally errs if the priority is
+// not one of the defined priorities.
+func (l *Limiter) EnqueuePriority(task LimitedDoer, region, method string, priority Priority) (uint32, error) {
 	l.lock.Lock()
 	defer l.lock.Unlock()
-	if l.isStopped {
-		return 0, fmt.Errorf("Limiter has been stopped")
+	if l.isStopping {
+		return 0, ErrLimiterStopped
 	}
-	var position uint32
-	if reg, ok := l.regions[region]; ok && reg.allowance() > 0 {
-		position = reg.allowance()
-		l.regions[region].reserve()
-		go l.execute(task, region)
-	} else {
-		if !ok {
-			return 0, fmt.Errorf("Cannot queue for unknown region '%s'", region)
-		} else if reg.hasZeroPeriod {
-			return 0, fmt.Errorf("No more requests are allowed for region '%s'", region)
+	if !priority.valid() {
+		return 0, fmt.Errorf("Unknown priority %d", priority)
+	}
+	reg, ok := l.regions[region]
+	if !ok {
+		return 0, fmt.Errorf("Cannot queue for unknown region '%s'", region)
+	}
+	m := reg.method(method)
+	now := l.clock.Now()
+	//Tasks already waiting for this method go first
+	if m.tasks.empty() && !reg.frozen(now) && !reg.full() {
+		res, err := l.store.Reserve(reg.limits(m), now)
+		if err == nil && res.OK {
+			reg.running++
+			reg.wait.observe(0)
+			go l.execute(task, reg, m, priority, res.Token)
+			return res.Remaining, nil
 		}
-		l.regions[region].tasks.Push(task)
-		position = 0
 	}
-	return position, nil
+	if reg.rates.hasZeroPeriod() || m.rates.hasZeroPeriod() {
+		reg.rejected++
+		return 0, fmt.Errorf("No more requests are allowed for region '%s'", region)
+	}
+	m.tasks.push(task, priority, now)
+	l.update()
+	return 0, nil
 }
 
-// Stopped returns true if this Limiter has had Stop() called on it.
-// Returns false otherwise.
+// SetMaxInFlight caps the number of tasks of the given region which may be
+// running at once, on top of its rates. A task which the rates would allow is
+// kept queued until one of the running tasks completes, so that a slow API
+// doesn't have many requests open at the same time. A max of zero, which is
+// the default, removes the cap. Errs if the region doesn't exist or if the
+// Limiter has been stopped.
+func (l *Limiter) SetMaxInFlight(region string, max int) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.isStopping {
+		return ErrLimiterStopped
+	}
+	if max < 0 {
+		return fmt.Errorf("Cannot cap region '%s' at %d tasks", region, max)
+	}
+	reg, ok := l.regions[region]
+	if !ok {
+		return fmt.Errorf("Cannot cap unknown region '%s'", region)
+	}
+	reg.maxInFlight = max
+	l.update()
+	return nil
+}
+
+// Cancel withdraws a task previously passed to Enqueue for the given region,
+// provided it is still waiting in the queue for allowance. Returns true if the
+// task was withdrawn, meaning it will never be performed. Returns false if the
+// task wasn't queued for that region, which includes tasks that have already
+// been released for execution.
+func (l *Limiter) Cancel(task LimitedDoer, region string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	reg, ok := l.regions[region]
+	if !ok {
+		return false
+	}
+	for _, m := range reg.methods {
+		if m.tasks.remove(task) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reprioritize moves a task previously passed to EnqueuePriority for the given
+// region to the back of the queue for another priority, such as when a more
+// urgent caller starts waiting on it. Returns true if the task was moved.
+// Returns false if the priority is not one of the defined priorities, or if the
+// task wasn't queued for that region, which includes tasks that have already
+// been released for execution.
+func (l *Limiter) Reprioritize(task LimitedDoer, region string, priority Priority) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	reg, ok := l.regions[region]
+	if !ok || !priority.valid() {
+		return false
+	}
+	for _, m := range reg.methods {
+		if m.tasks.move(task, priority) {
+			return true
+		}
+	}
+	return false
+}
+
+// Requeue puts a task back at the head of the given region's queue, so that it
+// is the next task performed once allowance is available. It is meant for tasks
+// that have already been performed once but need to be retried, such as
+// requests which the API turned away for exceeding its rate limits.
+// Errs if the region doesn't exist or if the Limiter has been stopped.
+func (l *Limiter) Requeue(task LimitedDoer, region string) error {
+	return l.RequeueMethod(task, region, "")
+}
+
+// RequeueMethod is Requeue for a task which was enqueued with EnqueueMethod.
+func (l *Limiter) RequeueMethod(task LimitedDoer, region, method string) error {
+	return l.RequeuePriority(task, region, method, PriorityNormal)
+}
+
+// RequeuePriority is Requeue for a task which was enqueued with
+// EnqueuePriority. The task goes to the head of the queue for its priority.
+func (l *Limiter) RequeuePriority(task LimitedDoer, region, method string, priority Priority) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.isStopped {
+		return ErrLimiterStopped
+	}
+	if !priority.valid() {
+		return fmt.Errorf("Unknown priority %d", priority)
+	}
+	reg, ok := l.regions[region]
+	if !ok {
+		return fmt.Errorf("Cannot requeue for unknown region '%s'", region)
+	}
+	reg.method(method).tasks.pushFront(task, priority, l.clock.Now())
+	l.update()
+	return nil
+}
+
+// Freeze withholds all allowance for the given region until the given time,
+// regardless of what its rates would otherwise allow. Tasks enqueued in the
+// meantime are queued, and are performed once the region thaws. Freezing a
+// region which is already frozen for longer has no effect.
+// Errs if the region doesn't exist or if the Limiter has been stopped.
+func (l *Limiter) Freeze(region string, until time.Time) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.isStopped {
+		return ErrLimiterStopped
+	}
+	reg, ok := l.regions[region]
+	if !ok {
+		return fmt.Errorf("Cannot freeze unknown region '%s'", region)
+	}
+	if until.After(reg.frozenUntil) {
+		reg.frozenUntil = until
+	}
+	l.update()
+	return nil
+}
+
+// SetDequeuePolicy changes the order in which queued tasks of different
+// priorities are released from now on, across all the methods of a region. The
+// default is StrictPriority.
+func (l *Limiter) SetDequeuePolicy(policy DequeuePolicy) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.policy = policy
+	l.update()
+}
+
+// QueueDepth reports how many tasks are waiting for allowance in the given
+// region, across all of its methods, for each priority. Errs if the region
+// doesn't exist.
+func (l *Limiter) QueueDepth(region string) (map[Priority]int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	reg, ok := l.regions[region]
+	if !ok {
+		return nil, fmt.Errorf("Cannot report on unknown region '%s'", region)
+	}
+	return reg.queueDepth(), nil
+}
+
+// Stopped returns true if this Limiter has had Stop() called on it, even if
+// it is still draining. Returns false otherwise.
 func (l *Limiter) Stopped() bool {
 	l.lock.Lock()
 	defer l.lock.Unlock()
-	return l.isStopped
+	return l.isStopping
 }
 
-func (l *Limiter) asyncUpdate() {
-	//Every second, refresh all the rate objects.
-	for range l.secondTicker.C {
-		l.lock.Lock()
-		if l.isStopped {
-			l.secondTicker.Stop()
-			l.lock.Unlock()
-			return
-		}
-		for _, region := range l.regions {
-			for _, rate := range region.rates {
-				rate.tick(l.clock)
-			}
+// method returns the method bucket of this region with the given name,
+// creating it if it doesn't exist yet.
+func (r *region) method(name string) *method {
+	m, ok := r.methods[name]
+	if !ok {
+		m = &method{
+			rates: rateSet{key: r.name + "/" + name},
+			tasks: newLanes(),
 		}
-		l.clock++
-		l.useAllowance()
-		l.lock.Unlock()
+		r.methods[name] = m
 	}
+	return m
 }
 
-func (r *rate) tick(clock uint32) {
-	if r.period == 0 {
-		return
+// dropQueued empties the queues of every method of this region, returning the
+// tasks which were waiting in them, to be rejected.
+func (r *region) dropQueued() []LimitedDoer {
+	var ret []LimitedDoer
+	for _, m := range r.methods {
+		for next := m.tasks.poll(StrictPriority); next.task != nil; next = m.tasks.poll(StrictPriority) {
+			ret = append(ret, next.task)
+		}
 	}
-	idx := clock % r.period
-	r.allowance += r.history[idx]
-	r.history[idx] = r.thisTick
-	r.thisTick = 0
+	r.rejected += uint64(len(ret))
+	return ret
 }
 
-func (r *region) allowance() (allowance uint32) {
-	allowance = 4294967295
-	for _, rate := range r.rates {
-		if rate.allowance < allowance {
-			allowance = rate.allowance
+// queueDepth counts the tasks waiting in this region, for each priority.
+func (r *region) queueDepth() map[Priority]int {
+	ret := make(map[Priority]int, numPriorities)
+	for p := Priority(0); p < numPriorities; p++ {
+		ret[p] = 0
+	}
+	for _, m := range r.methods {
+		for p, q := range m.tasks.queues {
+			ret[Priority(p)] += q.len()
 		}
 	}
-	return allowance
+	return ret
+}
+
+// limits describes the rates which a task of the given method of this region
+// is held to, those of both the method and the region, to a RateStore.
+func (r *region) limits(m *method) []Limit {
+	return append(r.rates.limits(), m.rates.limits()...)
+}
+
+// full is true if this region already has as many tasks running as it may.
+func (r *region) full() bool {
+	return r.maxInFlight > 0 && r.running >= r.maxInFlight
 }
 
-// Decrements the allowance of each rate contained within, but does not increment
-// the value of this tick. Effectively reserves an API call to this region that
-// cannot be used by other calls to enqueue.
-func (r *region) reserve() {
-	for _, rate := range r.rates {
-		rate.allowance--
+// defaultThrottleFreeze is how long a region held to no rates is frozen for when
+// a task of it is throttled without being told how long to wait.
+const defaultThrottleFreeze = time.Second
+
+// throttleFreeze is how long to freeze this region for when a task of method m
+// is throttled without being told how long to wait: the shortest period of the
+// rates the task is held to, so that the server has a chance to recover before
+// the task is tried again.
+func (r *region) throttleFreeze(m *method) time.Duration {
+	shortest := r.rates.shortestPeriod()
+	if period := m.rates.shortestPeriod(); period != 0 && (shortest == 0 || period < shortest) {
+		shortest = period
+	}
+	if shortest == 0 {
+		return defaultThrottleFreeze
 	}
+	return time.Duration(shortest) * time.Second
 }
 
-func (l *Limiter) execute(task LimitedDoer, region string) {
-	task.Do()
+// frozen is true if no tasks may be released for this region at the given
+// time, regardless of its rates.
+func (r *region) frozen(now time.Time) bool {
+	return now.Before(r.frozenUntil)
+}
+
+func (l *Limiter) execute(task LimitedDoer, r *region, m *method, priority Priority, token string) {
+	result := perform(task)
 	l.lock.Lock()
-	defer l.lock.Unlock()
-	r := l.regions[region]
-	for _, rate := range r.rates {
-		rate.thisTick++
+	now := l.clock.Now()
+	//Should either fail, the request keeps counting from when it was reserved
+	if result.Outcome == OutcomeNotSent {
+		l.store.Release(r.limits(m), token)
+	} else {
+		l.store.Complete(r.limits(m), token, now)
+	}
+	if result.Outcome == OutcomeThrottled {
+		r.throttled++
+		wait := result.RetryAfter
+		if wait <= 0 {
+			wait = r.throttleFreeze(m)
+		}
+		if until := now.Add(wait); until.After(r.frozenUntil) {
+			r.frozenUntil = until
+		}
+	}
+	r.running--
+	if result.Outcome == OutcomeSucceeded || result.Outcome == OutcomeFailed {
+		r.executed++
+	}
+	var rejectWith error
+	if result.Requeue {
+		switch {
+		case l.isStopped:
+			rejectWith = ErrLimiterStopped
+		case l.regions[r.name] != r:
+			rejectWith = ErrRegionRemoved
+		default:
+			m.tasks.pushFront(task, priority, now)
+		}
+	}
+	if rejectWith != nil {
+		r.rejected++
+	}
+	l.update()
+	l.lock.Unlock()
+	if rejectWith != nil {
+		rejectAll([]LimitedDoer{task}, rejectWith)
+	}
+}
+
+// update releases every queued task that is allowed to be performed now, then
+// sets the wake timer for the earliest instant at which another queued task
+// will be allowed. Must be called with the lock held, whenever allowance may
+// have been returned or new tasks may have been queued.
+func (l *Limiter) update() {
+	if l.isStopped {
+		return
+	}
+	next := l.useAllowance()
+	now := l.clock.Now()
+	if l.wakeTimer != nil {
+		l.wakeTimer.Stop()
+		l.wakeTimer = nil
+	}
+	if !next.IsZero() {
+		l.wakeTimer = l.clock.AfterFunc(next.Sub(now), l.wake)
+	}
+	if l.drained != nil && l.idle() {
+		close(l.drained)
+		l.drained = nil
 	}
 }
 
-func (l *Limiter) useAllowance() {
-	for name, r := range l.regions {
-		for r.allowance() > 0 && r.tasks.Peek() != nil {
-			r.reserve()
-			go l.execute(r.tasks.Poll().(LimitedDoer), name)
+// idle is true if the limiter has no tasks queued or running.
+func (l *Limiter) idle() bool {
+	for _, r := range l.regions {
+		if r.running > 0 {
+			return false
+		}
+		for _, m := range r.methods {
+			if !m.tasks.empty() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// wake is called by the wake timer once a queued task is due to be released.
+func (l *Limiter) wake() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.update()
+}
+
+// useAllowance releases queued tasks for as long as there is allowance for
+// them, and room for them under their region's cap on tasks in flight. Within a
+// region, the priority to release next is picked under the dequeue policy from
+// the tasks queued for all of its methods, and methods with tasks waiting at
+// that priority take turns releasing one each, so a busy method doesn't hold up
+// the others. Returns the earliest instant at which a task still queued may be
+// allowed, or the zero time if there is none.
+func (l *Limiter) useAllowance() (next time.Time) {
+	wakeAt := func(at time.Time) {
+		if !at.IsZero() && (next.IsZero() || at.Before(next)) {
+			next = at
+		}
+	}
+	now := l.clock.Now()
+	for _, r := range l.regions {
+		var waiting []*method
+		for _, m := range r.methods {
+			if !m.tasks.empty() {
+				waiting = append(waiting, m)
+			}
+		}
+		if len(waiting) > 0 && r.frozen(now) {
+			wakeAt(r.frozenUntil)
+			continue
+		}
+		//A region which is full is woken up again once a task completes
+		for len(waiting) > 0 && !r.full() {
+			//The credit is only spent if a task is released at the priority
+			credit := r.credit
+			p, _ := nextPriority(l.policy, &credit, func(p Priority) bool {
+				for _, m := range waiting {
+					if m.tasks.waiting(p) {
+						return true
+					}
+				}
+				return false
+			})
+			for i := 0; i < len(waiting); {
+				m := waiting[i]
+				if !m.tasks.waiting(p) {
+					i++
+					continue
+				}
+				//A method without allowance can't release tasks of any priority
+				waiting = append(waiting[:i], waiting[i+1:]...)
+				res, err := l.store.Reserve(r.limits(m), now)
+				if err != nil {
+					wakeAt(now.Add(storeRetryDelay))
+					continue
+				}
+				if !res.OK {
+					wakeAt(res.RetryAt)
+					continue
+				}
+				next := m.tasks.pollPriority(p)
+				r.credit = credit
+				r.running++
+				r.wait.observe(now.Sub(next.since))
+				go l.execute(next.task, r, m, next.priority, res.Token)
+				//Go to the back of the line for its next turn
+				if !m.tasks.empty() {
+					waiting = append(waiting, m)
+				}
+				break
+			}
 		}
 	}
+	return next
 }
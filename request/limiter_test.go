@@ -1,9 +1,15 @@
 package request_test
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"time"
 
 	. "github.com/thomasmmitchell/recentlyplayedplus/request"
+	"github.com/thomasmmitchell/recentlyplayedplus/request/fakeclock"
+	"github.com/thomasmmitchell/recentlyplayedplus/types"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -25,13 +31,105 @@ func (td *TestDoer) Do() {
 	td.channel <- td.value
 }
 
+//A TestDoer which records being rejected, rather than performed.
+type RejectTestDoer struct {
+	*TestDoer
+	rejected chan error
+}
+
+func newRejectTestDoer(value int) *RejectTestDoer {
+	return &RejectTestDoer{
+		TestDoer: newTestDoer(value),
+		rejected: make(chan error, 1),
+	}
+}
+
+func (rtd *RejectTestDoer) Reject(err error) {
+	rtd.rejected <- err
+}
+
+//A TestDoer which doesn't complete until it is told to finish.
+type BlockingTestDoer struct {
+	*TestDoer
+	started  chan struct{}
+	finished chan struct{}
+}
+
+func newBlockingTestDoer(value int) *BlockingTestDoer {
+	return &BlockingTestDoer{
+		TestDoer: newTestDoer(value),
+		started:  make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+}
+
+func (btd *BlockingTestDoer) Do() {
+	close(btd.started)
+	<-btd.finished
+	btd.TestDoer.Do()
+}
+
+//Lets the task complete. Safe to call more than once.
+func (btd *BlockingTestDoer) finish() {
+	select {
+	case <-btd.finished:
+	default:
+		close(btd.finished)
+	}
+}
+
+//A TestDoer which reports the given results, one per time it is performed.
+type ResultTestDoer struct {
+	*TestDoer
+	results []Result
+}
+
+func newResultTestDoer(value int, results ...Result) *ResultTestDoer {
+	return &ResultTestDoer{
+		TestDoer: newTestDoer(value),
+		results:  results,
+	}
+}
+
+func (rtd *ResultTestDoer) DoResult() Result {
+	result := rtd.results[0]
+	rtd.results = rtd.results[1:]
+	rtd.Do()
+	return result
+}
+
+//The clock of the limiter under test
+var clock *fakeclock.Clock
+
+//How long to give tasks released by the limiter to be performed, in real time.
+const settleTime = 100 * time.Millisecond
+
 //int is the value from the channel. bool is whether or not the value
-// was retrieved before timing out.
+// was retrieved before the limiter's clock moved on by timeout seconds.
+// The clock is moved on from one timer to the next, giving released tasks
+// time to be performed in between, so it stops as soon as the task is done.
 func (td *TestDoer) popChannel(timeout time.Duration) (int, bool) {
+	deadline := clock.Now().Add(timeout * time.Second)
+	for {
+		if v, ok := td.wait(settleTime); ok {
+			return v, true
+		}
+		next, ok := clock.Next()
+		if !ok || next.After(deadline) {
+			clock.Advance(deadline.Sub(clock.Now()))
+			return td.wait(settleTime)
+		}
+		clock.Advance(next.Sub(clock.Now()))
+	}
+}
+
+//Waits up to the given amount of real time for the task to be performed,
+// without moving the limiter's clock.
+func (td *TestDoer) wait(timeout time.Duration) (int, bool) {
 	select {
 	case v := <-(td.channel):
 		return v, true
-	case <-time.After(timeout * time.Second):
+	case <-time.After(timeout):
 		return 0, false
 	}
 }
@@ -42,12 +140,13 @@ var _ = Describe("Limiter", func() {
 	var lim *Limiter
 
 	BeforeEach(func() {
-		lim = NewLimiter()
+		clock = fakeclock.New(time.Date(2016, time.June, 1, 0, 0, 0, 0, time.UTC))
+		lim = NewLimiterWithClock(clock)
 		Ω(lim).ShouldNot(BeNil(), "A new limiter should have been allocated.")
 	})
 
 	AfterEach(func() {
-		lim.Stop()
+		lim.Stop(context.Background(), RejectQueued)
 	})
 
 	Context("When there are no regions", func() {
@@ -85,6 +184,24 @@ var _ = Describe("Limiter", func() {
 				Ω(output).Should(Equal(input), "The task should have returned")
 			})
 
+			It("should hold tasks while the region is frozen", func() {
+				err := lim.Freeze(reg, clock.Now().Add(2*time.Second))
+				Ω(err).ShouldNot(HaveOccurred(), "Should be able to freeze a region")
+				doer := newTestDoer(0)
+				allowance, err := lim.Enqueue(doer, reg)
+				Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err while frozen")
+				Ω(allowance).Should(Equal(uint32(0)), "A frozen region should have no allowance")
+				_, retrieved := doer.popChannel(1)
+				Ω(retrieved).Should(BeFalse(), "The task should wait out the freeze")
+				_, retrieved = doer.popChannel(3)
+				Ω(retrieved).Should(BeTrue(), "The task should be performed after the freeze")
+			})
+
+		})
+
+		It("should err if a non-existant region is frozen", func() {
+			err := lim.Freeze(notreg, clock.Now().Add(time.Second))
+			Ω(err).Should(HaveOccurred(), "Should not be able to freeze a non-existant region")
 		})
 
 		It("should err if enqueue is attempted for a non-existant region", func() {
@@ -132,6 +249,118 @@ var _ = Describe("Limiter", func() {
 			})
 
 		})
+		Context("with a rate that allows a burst", func() {
+			BeforeEach(func() {
+				limit = 2
+				period = 3
+				lim.AddRate(limit, period, reg)
+			})
+
+			It("should release a queued task as soon as the rate allows it", func() {
+				for i := 0; i < int(limit); i++ {
+					doer := newTestDoer(i)
+					_, err := lim.Enqueue(doer, reg)
+					Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+					_, retrieved := doer.wait(settleTime)
+					Ω(retrieved).Should(BeTrue(), "The burst should be performed immediately")
+				}
+				doer := newTestDoer(int(limit))
+				allowance, err := lim.Enqueue(doer, reg)
+				Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+				Ω(allowance).Should(Equal(uint32(0)), "Should need to queue this for later")
+				clock.BlockUntil(1)
+				clock.Advance(time.Duration(period)*time.Second - time.Millisecond)
+				_, retrieved := doer.wait(settleTime)
+				Ω(retrieved).Should(BeFalse(), "Should not have beaten the rate")
+				clock.Advance(time.Millisecond)
+				_, retrieved = doer.wait(settleTime)
+				Ω(retrieved).Should(BeTrue(), "Should have completed the moment the burst expired")
+			})
+		})
+
+		Context("with a rate of a ten minute period", func() {
+			BeforeEach(func() {
+				limit = 500
+				period = 600
+				lim.AddRate(limit, period, reg)
+			})
+
+			It("should hold tasks for the whole period once the allowance is depleted", func() {
+				for i := 0; i < int(limit); i++ {
+					doer := newTestDoer(i)
+					_, err := lim.Enqueue(doer, reg)
+					Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+					_, retrieved := doer.wait(settleTime)
+					Ω(retrieved).Should(BeTrue(), "The allowance should be performed immediately")
+				}
+				doer := newTestDoer(int(limit))
+				allowance, err := lim.Enqueue(doer, reg)
+				Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+				Ω(allowance).Should(Equal(uint32(0)), "Should need to queue this for later")
+				_, retrieved := doer.popChannel(599)
+				Ω(retrieved).Should(BeFalse(), "Should need to wait out the period")
+				_, retrieved = doer.popChannel(1)
+				Ω(retrieved).Should(BeTrue(), "Should have completed once the period passed")
+			})
+		})
+
+		Context("when reconciling with the server's view of the rates", func() {
+			BeforeEach(func() {
+				limit = 10
+				period = 20
+				lim.AddRate(limit, period, reg)
+			})
+
+			It("should use up allowance the server has counted", func() {
+				err := lim.Reconcile(reg, nil, map[uint32]uint32{period: limit})
+				Ω(err).ShouldNot(HaveOccurred(), "Reconcile shouldn't err here.")
+				allowance, err := lim.Enqueue(newTestDoer(0), reg)
+				Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+				Ω(allowance).Should(Equal(uint32(0)), "The server's count should have used the allowance")
+			})
+
+			It("should not give back allowance the server hasn't counted", func() {
+				testSingleTask()
+				err := lim.Reconcile(reg, nil, map[uint32]uint32{period: 0})
+				Ω(err).ShouldNot(HaveOccurred(), "Reconcile shouldn't err here.")
+				allowance, err := lim.Enqueue(newTestDoer(0), reg)
+				Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+				Ω(allowance).Should(Equal(limit-1), "A lower count from the server should be ignored")
+			})
+
+			It("should lower the max of a rate to the server's limit", func() {
+				err := lim.Reconcile(reg, map[uint32]uint32{period: 2}, nil)
+				Ω(err).ShouldNot(HaveOccurred(), "Reconcile shouldn't err here.")
+				allowance, err := lim.Enqueue(newTestDoer(0), reg)
+				Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+				Ω(allowance).Should(Equal(uint32(2)), "The allowance should have been cut to the new max")
+			})
+
+			It("should not raise the max of a rate to the server's limit", func() {
+				err := lim.Reconcile(reg, map[uint32]uint32{period: 2 * limit}, nil)
+				Ω(err).ShouldNot(HaveOccurred(), "Reconcile shouldn't err here.")
+				testSingleTask()
+			})
+
+			It("should add rates that it didn't know about", func() {
+				err := lim.Reconcile(reg, map[uint32]uint32{3: 1}, map[uint32]uint32{3: 1})
+				Ω(err).ShouldNot(HaveOccurred(), "Reconcile shouldn't err here.")
+				doer := newTestDoer(0)
+				allowance, err := lim.Enqueue(doer, reg)
+				Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+				Ω(allowance).Should(Equal(uint32(0)), "The discovered rate should be used up")
+				_, retrieved := doer.popChannel(1)
+				Ω(retrieved).Should(BeFalse(), "Should need to wait for the discovered rate")
+				_, retrieved = doer.popChannel(4)
+				Ω(retrieved).Should(BeTrue(), "Should complete once the discovered rate allows")
+			})
+
+			It("should err for a non-existant region", func() {
+				err := lim.Reconcile(notreg, nil, nil)
+				Ω(err).Should(HaveOccurred(), "Should not be able to reconcile a non-existant region")
+			})
+		})
+
 		Context("with a single small rate", func() {
 			BeforeEach(func() {
 
@@ -157,6 +386,358 @@ var _ = Describe("Limiter", func() {
 				Ω(retrieved).Should(BeTrue(), "Should finally have completed")
 				Ω(output).Should(Equal(input), "The task should have returned the input value")
 			})
+
+			It("should never perform a task cancelled while queued", func() {
+				testSingleTask()
+				doer := newTestDoer(1)
+				allowance, err := lim.Enqueue(doer, reg)
+				Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+				Ω(allowance).Should(Equal(uint32(0)), "Should need to queue this for later")
+				Ω(lim.Cancel(doer, reg)).Should(BeTrue(), "A queued task should be cancellable")
+				_, retrieved := doer.popChannel(4)
+				Ω(retrieved).Should(BeFalse(), "A cancelled task should not be performed")
+				Ω(lim.Cancel(doer, reg)).Should(BeFalse(), "A task can only be cancelled once")
+			})
+
+			It("should perform a requeued task before tasks already waiting", func() {
+				testSingleTask()
+				waiting := newTestDoer(1)
+				_, err := lim.Enqueue(waiting, reg)
+				Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+				requeued := newTestDoer(2)
+				err = lim.Requeue(requeued, reg)
+				Ω(err).ShouldNot(HaveOccurred(), "Requeue shouldn't err here.")
+				_, retrieved := requeued.popChannel(5)
+				Ω(retrieved).Should(BeTrue(), "The requeued task should be performed first")
+				_, retrieved = waiting.popChannel(1)
+				Ω(retrieved).Should(BeFalse(), "The waiting task should still be waiting")
+			})
+
+			It("should not cancel a task that has already been performed", func() {
+				doer := newTestDoer(0)
+				_, err := lim.Enqueue(doer, reg)
+				Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+				_, retrieved := doer.popChannel(1)
+				Ω(retrieved).Should(BeTrue(), "Should have retrieved value")
+				Ω(lim.Cancel(doer, reg)).Should(BeFalse(), "A performed task can't be cancelled")
+			})
+		})
+
+		Context("with rates for a method", func() {
+			method, otherMethod := "slow", "other"
+
+			BeforeEach(func() {
+				limit = 10
+				period = 20
+				lim.AddRate(limit, period, reg)
+				err := lim.AddMethodRate(1, 3, reg, method)
+				Ω(err).ShouldNot(HaveOccurred(), "Should be able to add a method rate")
+			})
+
+			It("should obey the method's rate for tasks of that method", func() {
+				doer := newTestDoer(0)
+				allowance, err := lim.EnqueueMethod(doer, reg, method)
+				Ω(err).ShouldNot(HaveOccurred(), "EnqueueMethod shouldn't err here.")
+				Ω(allowance).Should(Equal(uint32(1)), "The method's rate should be the tightest")
+				_, retrieved := doer.popChannel(1)
+				Ω(retrieved).Should(BeTrue(), "Should have retrieved value")
+				doer = newTestDoer(1)
+				allowance, err = lim.EnqueueMethod(doer, reg, method)
+				Ω(err).ShouldNot(HaveOccurred(), "EnqueueMethod shouldn't err here.")
+				Ω(allowance).Should(Equal(uint32(0)), "Should need to queue this for later")
+				_, retrieved = doer.popChannel(1)
+				Ω(retrieved).Should(BeFalse(), "Should need to wait for the method's allowance")
+				_, retrieved = doer.popChannel(4)
+				Ω(retrieved).Should(BeTrue(), "Should finally have completed")
+			})
+
+			It("should not hold other methods to the method's rate", func() {
+				_, err := lim.EnqueueMethod(newTestDoer(0), reg, method)
+				Ω(err).ShouldNot(HaveOccurred(), "EnqueueMethod shouldn't err here.")
+				_, err = lim.EnqueueMethod(newTestDoer(1), reg, method)
+				Ω(err).ShouldNot(HaveOccurred(), "EnqueueMethod shouldn't err here.")
+				doer := newTestDoer(2)
+				allowance, err := lim.EnqueueMethod(doer, reg, otherMethod)
+				Ω(err).ShouldNot(HaveOccurred(), "EnqueueMethod shouldn't err here.")
+				Ω(allowance).Should(Equal(limit-1), "Only the region's rate should apply")
+				_, retrieved := doer.popChannel(1)
+				Ω(retrieved).Should(BeTrue(), "Should not wait behind the other method")
+			})
+
+			It("should cancel a task queued for a method", func() {
+				_, err := lim.EnqueueMethod(newTestDoer(0), reg, method)
+				Ω(err).ShouldNot(HaveOccurred(), "EnqueueMethod shouldn't err here.")
+				doer := newTestDoer(1)
+				_, err = lim.EnqueueMethod(doer, reg, method)
+				Ω(err).ShouldNot(HaveOccurred(), "EnqueueMethod shouldn't err here.")
+				Ω(lim.Cancel(doer, reg)).Should(BeTrue(), "A queued task should be cancellable")
+			})
+		})
+
+		Context("with tasks of different priorities waiting", func() {
+			var interactive []*TestDoer
+			var background *TestDoer
+
+			BeforeEach(func() {
+				limit = 3
+				period = 100
+				lim.AddRate(limit, period, reg)
+				err := lim.Freeze(reg, clock.Now().Add(time.Second))
+				Ω(err).ShouldNot(HaveOccurred(), "Should be able to freeze a region")
+				background = newTestDoer(-1)
+				_, err = lim.EnqueuePriority(background, reg, "", PriorityBackground)
+				Ω(err).ShouldNot(HaveOccurred(), "EnqueuePriority shouldn't err here.")
+				interactive = nil
+				for i := 0; i < 5; i++ {
+					doer := newTestDoer(i)
+					interactive = append(interactive, doer)
+					_, err = lim.EnqueuePriority(doer, reg, "", PriorityInteractive)
+					Ω(err).ShouldNot(HaveOccurred(), "EnqueuePriority shouldn't err here.")
+				}
+			})
+
+			It("should report the depth of each priority's queue", func() {
+				depth, err := lim.QueueDepth(reg)
+				Ω(err).ShouldNot(HaveOccurred(), "QueueDepth shouldn't err here.")
+				Ω(depth).Should(Equal(map[Priority]int{
+					PriorityInteractive: 5,
+					PriorityNormal:      0,
+					PriorityBackground:  1,
+				}))
+			})
+
+			It("should release higher priorities first by default", func() {
+				for i := 0; i < int(limit); i++ {
+					_, retrieved := interactive[i].popChannel(3)
+					Ω(retrieved).Should(BeTrue(), "Interactive tasks should be released first")
+				}
+				_, retrieved := background.popChannel(1)
+				Ω(retrieved).Should(BeFalse(), "The background task should still be waiting")
+				depth, err := lim.QueueDepth(reg)
+				Ω(err).ShouldNot(HaveOccurred(), "QueueDepth shouldn't err here.")
+				Ω(depth[PriorityBackground]).Should(Equal(1))
+				Ω(depth[PriorityInteractive]).Should(Equal(2))
+			})
+
+			It("should give lower priorities a share when weighted fairly", func() {
+				lim.SetDequeuePolicy(WeightedFair)
+				_, retrieved := background.popChannel(3)
+				Ω(retrieved).Should(BeTrue(), "The background task should get a turn")
+				depth, err := lim.QueueDepth(reg)
+				Ω(err).ShouldNot(HaveOccurred(), "QueueDepth shouldn't err here.")
+				Ω(depth[PriorityInteractive]).Should(Equal(3))
+			})
+
+			It("should move a queued task to the queue of another priority", func() {
+				Ω(lim.Reprioritize(background, reg, PriorityInteractive)).Should(BeTrue(), "A queued task should be movable")
+				depth, err := lim.QueueDepth(reg)
+				Ω(err).ShouldNot(HaveOccurred(), "QueueDepth shouldn't err here.")
+				Ω(depth[PriorityInteractive]).Should(Equal(6))
+				Ω(depth[PriorityBackground]).Should(BeZero())
+				Ω(lim.Reprioritize(background, reg, Priority(42))).Should(BeFalse(), "Should not move a task to an unknown priority")
+				Ω(lim.Reprioritize(newTestDoer(0), reg, PriorityNormal)).Should(BeFalse(), "Should not move a task which isn't queued")
+				Ω(lim.Reprioritize(background, notreg, PriorityNormal)).Should(BeFalse(), "Should not move a task of a non-existant region")
+			})
+
+			It("should err for an unknown priority", func() {
+				_, err := lim.EnqueuePriority(newTestDoer(0), reg, "", Priority(42))
+				Ω(err).Should(HaveOccurred(), "Should not be able to enqueue with an unknown priority")
+			})
+		})
+
+		Context("with tasks of different priorities waiting on different methods", func() {
+			var interactive []*TestDoer
+			var background *TestDoer
+
+			BeforeEach(func() {
+				limit = 3
+				period = 100
+				lim.AddRate(limit, period, reg)
+				err := lim.Freeze(reg, clock.Now().Add(time.Second))
+				Ω(err).ShouldNot(HaveOccurred(), "Should be able to freeze a region")
+				background = newTestDoer(-1)
+				_, err = lim.EnqueuePriority(background, reg, "crawl", PriorityBackground)
+				Ω(err).ShouldNot(HaveOccurred(), "EnqueuePriority shouldn't err here.")
+				interactive = nil
+				for i := 0; i < 4; i++ {
+					doer := newTestDoer(i)
+					interactive = append(interactive, doer)
+					_, err = lim.EnqueuePriority(doer, reg, "lookup", PriorityInteractive)
+					Ω(err).ShouldNot(HaveOccurred(), "EnqueuePriority shouldn't err here.")
+				}
+			})
+
+			It("should release higher priorities first whichever method they are for", func() {
+				for i := 0; i < int(limit); i++ {
+					_, retrieved := interactive[i].popChannel(3)
+					Ω(retrieved).Should(BeTrue(), "Interactive tasks should be released first")
+				}
+				_, retrieved := background.popChannel(1)
+				Ω(retrieved).Should(BeFalse(), "The background task should still be waiting")
+				depth, err := lim.QueueDepth(reg)
+				Ω(err).ShouldNot(HaveOccurred(), "QueueDepth shouldn't err here.")
+				Ω(depth[PriorityBackground]).Should(Equal(1))
+				Ω(depth[PriorityInteractive]).Should(Equal(1))
+			})
+
+			It("should give lower priorities of other methods a share when weighted fairly", func() {
+				lim.SetDequeuePolicy(WeightedFair)
+				_, retrieved := background.popChannel(3)
+				Ω(retrieved).Should(BeTrue(), "The background task should get a turn")
+				depth, err := lim.QueueDepth(reg)
+				Ω(err).ShouldNot(HaveOccurred(), "QueueDepth shouldn't err here.")
+				Ω(depth[PriorityInteractive]).Should(Equal(2))
+			})
+		})
+
+		It("should err if queue depth is requested for a non-existant region", func() {
+			_, err := lim.QueueDepth(notreg)
+			Ω(err).Should(HaveOccurred(), "Should not report on a non-existant region")
+		})
+
+		Context("with a small rate and a method without rates", func() {
+			BeforeEach(func() {
+				limit = 1
+				period = 3
+				lim.AddRate(limit, period, reg)
+			})
+
+			It("should hold tasks of the method to the region's rate", func() {
+				doer := newTestDoer(0)
+				_, err := lim.EnqueueMethod(doer, reg, "free")
+				Ω(err).ShouldNot(HaveOccurred(), "EnqueueMethod shouldn't err here.")
+				_, retrieved := doer.popChannel(1)
+				Ω(retrieved).Should(BeTrue(), "Should have retrieved value")
+				allowance, err := lim.Enqueue(newTestDoer(1), reg)
+				Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+				Ω(allowance).Should(Equal(uint32(0)), "The method's task should have used the region's allowance")
+			})
+		})
+
+		Context("with tasks that report their results", func() {
+			BeforeEach(func() {
+				Ω(lim.AddRate(1, 10, reg)).Should(Succeed(), "Should be able to add a rate")
+			})
+
+			It("should refund allowance for a request that was never sent", func() {
+				doer := newResultTestDoer(0, Result{Outcome: OutcomeNotSent})
+				_, err := lim.Enqueue(doer, reg)
+				Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+				_, retrieved := doer.wait(settleTime)
+				Ω(retrieved).Should(BeTrue(), "Should be performed straight away")
+				Eventually(func() map[uint32]uint32 {
+					metrics, _ := lim.Metrics()
+					return metrics[0].Allowance
+				}).Should(Equal(map[uint32]uint32{10: 1}), "The allowance should have been refunded")
+				metrics, err := lim.Metrics()
+				Ω(err).ShouldNot(HaveOccurred(), "Metrics shouldn't err here.")
+				Ω(metrics[0].Executed).Should(BeZero(), "A request never sent shouldn't count as executed")
+			})
+
+			It("should keep allowance for a request that failed", func() {
+				doer := newResultTestDoer(0, Result{Outcome: OutcomeFailed})
+				_, err := lim.Enqueue(doer, reg)
+				Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+				_, retrieved := doer.wait(settleTime)
+				Ω(retrieved).Should(BeTrue(), "Should be performed straight away")
+				Eventually(func() uint64 {
+					metrics, _ := lim.Metrics()
+					return metrics[0].Executed
+				}).Should(BeEquivalentTo(1), "The task should complete")
+				allowance, err := lim.Enqueue(newTestDoer(1), reg)
+				Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+				Ω(allowance).Should(Equal(uint32(0)), "The failed request should still count")
+			})
+
+			It("should freeze the region and requeue a throttled task", func() {
+				doer := newResultTestDoer(0,
+					Result{Outcome: OutcomeThrottled, RetryAfter: 20 * time.Second, Requeue: true},
+					Result{Outcome: OutcomeSucceeded})
+				_, err := lim.Enqueue(doer, reg)
+				Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+				_, retrieved := doer.wait(settleTime)
+				Ω(retrieved).Should(BeTrue(), "Should be performed straight away")
+				_, retrieved = doer.popChannel(19)
+				Ω(retrieved).Should(BeFalse(), "Should wait out the freeze, not just the rate")
+				_, retrieved = doer.popChannel(2)
+				Ω(retrieved).Should(BeTrue(), "Should be performed again once the region thaws")
+				metrics, err := lim.Metrics()
+				Ω(err).ShouldNot(HaveOccurred(), "Metrics shouldn't err here.")
+				Ω(metrics[0].Throttled).Should(BeEquivalentTo(1), "The throttled task should be counted")
+				Eventually(func() uint64 {
+					metrics, _ := lim.Metrics()
+					return metrics[0].Executed
+				}).Should(BeEquivalentTo(1), "Only the attempt which got through should count as executed")
+			})
+		})
+
+		Context("with tasks throttled without being told how long to wait", func() {
+			BeforeEach(func() {
+				Ω(lim.AddRate(10, 2, reg)).Should(Succeed(), "Should be able to add a rate")
+				Ω(lim.AddRate(100, 60, reg)).Should(Succeed(), "Should be able to add a rate")
+			})
+
+			It("should freeze the region for the shortest period of its rates", func() {
+				doer := newResultTestDoer(0,
+					Result{Outcome: OutcomeThrottled, Requeue: true},
+					Result{Outcome: OutcomeSucceeded})
+				_, err := lim.Enqueue(doer, reg)
+				Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+				_, retrieved := doer.wait(settleTime)
+				Ω(retrieved).Should(BeTrue(), "Should be performed straight away")
+				_, retrieved = doer.popChannel(1)
+				Ω(retrieved).Should(BeFalse(), "Should not be tried again while the region has allowance")
+				_, retrieved = doer.popChannel(2)
+				Ω(retrieved).Should(BeTrue(), "Should be performed again once the region thaws")
+			})
+		})
+
+		Context("with a cap on tasks in flight", func() {
+			var blockers []*BlockingTestDoer
+
+			BeforeEach(func() {
+				Ω(lim.SetMaxInFlight(reg, 2)).Should(Succeed(), "Should be able to cap the region")
+				blockers = nil
+				for i := 0; i < 2; i++ {
+					blocker := newBlockingTestDoer(i)
+					_, err := lim.Enqueue(blocker, reg)
+					Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+					Eventually(blocker.started).Should(BeClosed(), "Should be performed straight away")
+					blockers = append(blockers, blocker)
+				}
+			})
+
+			AfterEach(func() {
+				for _, blocker := range blockers {
+					blocker.finish()
+				}
+			})
+
+			It("should hold tasks back until a running task completes", func() {
+				doer := newTestDoer(2)
+				allowance, err := lim.Enqueue(doer, reg)
+				Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+				Ω(allowance).Should(Equal(uint32(0)), "Should need to queue this for later")
+				_, retrieved := doer.popChannel(10)
+				Ω(retrieved).Should(BeFalse(), "Should wait for room in flight")
+				blockers[0].finish()
+				_, retrieved = doer.wait(time.Second)
+				Ω(retrieved).Should(BeTrue(), "Should be performed once a running task completes")
+			})
+
+			It("should release held tasks once the cap is lifted", func() {
+				doer := newTestDoer(2)
+				_, err := lim.Enqueue(doer, reg)
+				Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+				Ω(lim.SetMaxInFlight(reg, 0)).Should(Succeed(), "Should be able to lift the cap")
+				_, retrieved := doer.wait(time.Second)
+				Ω(retrieved).Should(BeTrue(), "Should be performed once the cap is lifted")
+			})
+
+			It("should err for a negative cap or a non-existant region", func() {
+				Ω(lim.SetMaxInFlight(reg, -1)).ShouldNot(Succeed(), "Should not be able to set a negative cap")
+				Ω(lim.SetMaxInFlight(notreg, 1)).ShouldNot(Succeed(), "Should not be able to cap a non-existant region")
+			})
 		})
 
 		Context("with a rate containing a period of zero", func() {
@@ -285,12 +866,209 @@ var _ = Describe("Limiter", func() {
 
 	})
 
+	Context("When limiters share a RateStore", func() {
+		reg := "NA"
+		var other *Limiter
+
+		BeforeEach(func() {
+			store := NewMemoryStore()
+			lim = NewLimiterWithStore(store, clock)
+			other = NewLimiterWithStore(store, clock)
+			for _, l := range []*Limiter{lim, other} {
+				Ω(l.AddRegion(reg)).Should(Succeed(), "Should be able to add a region")
+				Ω(l.AddRate(2, 3, reg)).Should(Succeed(), "Should be able to add a rate")
+			}
+		})
+
+		AfterEach(func() {
+			other.Stop(context.Background(), RejectQueued)
+		})
+
+		It("should share one budget for the region", func() {
+			allowance, err := lim.Enqueue(newTestDoer(0), reg)
+			Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+			Ω(allowance).Should(Equal(uint32(2)), "Should start with the full allowance")
+			allowance, err = other.Enqueue(newTestDoer(1), reg)
+			Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+			Ω(allowance).Should(Equal(uint32(1)), "Should see the allowance used by the other limiter")
+			doer := newTestDoer(2)
+			allowance, err = other.Enqueue(doer, reg)
+			Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+			Ω(allowance).Should(Equal(uint32(0)), "Should need to queue this for later")
+			_, retrieved := doer.popChannel(2)
+			Ω(retrieved).Should(BeFalse(), "Should wait for the shared allowance")
+			_, retrieved = doer.popChannel(2)
+			Ω(retrieved).Should(BeTrue(), "Should complete once the shared allowance returns")
+		})
+	})
+
+	Context("When the limiter is persisted to a file", func() {
+		reg := "NA"
+		var dir, path string
+
+		restart := func() {
+			lim.Stop(context.Background(), RejectQueued)
+			lim = NewLimiterWithClock(clock)
+			Ω(lim.AddRegion(reg)).Should(Succeed(), "Should be able to add a region")
+			Ω(lim.AddRate(2, 600, reg)).Should(Succeed(), "Should be able to add a rate")
+			Ω(lim.PersistTo(path, 0)).Should(Succeed(), "Should be able to restore the limiter")
+		}
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "limiter")
+			Ω(err).ShouldNot(HaveOccurred(), "Should be able to make a directory")
+			path = filepath.Join(dir, "limits.json")
+			restart()
+			for i := 0; i < 2; i++ {
+				doer := newTestDoer(i)
+				_, err := lim.Enqueue(doer, reg)
+				Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+				_, retrieved := doer.wait(settleTime)
+				Ω(retrieved).Should(BeTrue(), "Should be performed straight away")
+			}
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should remember allowance used before a restart", func() {
+			clock.Advance(100 * time.Second)
+			restart()
+			doer := newTestDoer(0)
+			allowance, err := lim.Enqueue(doer, reg)
+			Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+			Ω(allowance).Should(Equal(uint32(0)), "The allowance should still be used up")
+			_, retrieved := doer.popChannel(499)
+			Ω(retrieved).Should(BeFalse(), "Should wait out the rest of the period")
+			_, retrieved = doer.popChannel(2)
+			Ω(retrieved).Should(BeTrue(), "Should complete once the period is over")
+		})
+
+		It("should account for time passed while stopped", func() {
+			clock.Advance(600 * time.Second)
+			restart()
+			allowance, err := lim.Enqueue(newTestDoer(0), reg)
+			Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+			Ω(allowance).Should(Equal(uint32(2)), "The period should have passed while stopped")
+		})
+
+		It("should save a snapshot periodically", func() {
+			Ω(lim.PersistTo(path, time.Minute)).Should(Succeed(), "Should be able to persist the limiter")
+			_, err := os.Stat(path)
+			Ω(os.IsNotExist(err)).Should(BeTrue(), "Nothing should be saved yet")
+			clock.Advance(time.Minute)
+			Eventually(func() error {
+				_, err := os.Stat(path)
+				return err
+			}).ShouldNot(HaveOccurred(), "A snapshot should have been saved")
+		})
+
+		It("should err on a file which isn't a snapshot", func() {
+			Ω(ioutil.WriteFile(path, []byte("not a snapshot"), 0644)).Should(Succeed())
+			other := NewLimiterWithClock(clock)
+			defer other.Stop(context.Background(), RejectQueued)
+			Ω(other.PersistTo(path, 0)).ShouldNot(Succeed(), "Should not restore from garbage")
+		})
+	})
+
+	Context("When reconfigured at runtime", func() {
+		reg := "NA"
+
+		BeforeEach(func() {
+			Ω(lim.AddRegion(reg)).Should(Succeed(), "Should be able to add a region")
+			Ω(lim.AddRate(2, 600, reg)).Should(Succeed(), "Should be able to add a rate")
+			for i := 0; i < 2; i++ {
+				_, err := lim.Enqueue(newTestDoer(i), reg)
+				Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+			}
+		})
+
+		It("should carry usage over to a rate added to a live region", func() {
+			Ω(lim.AddRate(5, 10, reg)).Should(Succeed(), "Should be able to add a rate")
+			Ω(lim.UpdateRates(reg, []types.Rate{{Period: 10, Max: 5}})).Should(Succeed(), "Should be able to update the rates")
+			metrics, err := lim.Metrics()
+			Ω(err).ShouldNot(HaveOccurred(), "Metrics shouldn't err here.")
+			Ω(metrics[0].Allowance).Should(Equal(map[uint32]uint32{10: 3}), "The new rate should count earlier requests")
+		})
+
+		It("should keep usage when a rate's max changes", func() {
+			Ω(lim.UpdateRates(reg, []types.Rate{{Period: 600, Max: 3}})).Should(Succeed(), "Should be able to update the rates")
+			allowance, err := lim.Enqueue(newTestDoer(2), reg)
+			Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+			Ω(allowance).Should(Equal(uint32(1)), "Only the raised allowance should be left")
+		})
+
+		It("should release queued tasks once a rate is raised", func() {
+			doer := newTestDoer(2)
+			_, err := lim.Enqueue(doer, reg)
+			Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+			Ω(lim.UpdateRates(reg, []types.Rate{{Period: 600, Max: 3}})).Should(Succeed(), "Should be able to update the rates")
+			_, retrieved := doer.wait(settleTime)
+			Ω(retrieved).Should(BeTrue(), "The raised rate should allow the queued task")
+		})
+
+		It("should err on rates with the same period", func() {
+			err := lim.UpdateRates(reg, []types.Rate{{Period: 10, Max: 1}, {Period: 10, Max: 2}})
+			Ω(err).Should(HaveOccurred(), "Two rates with one period should not be allowed")
+			Ω(lim.UpdateRates("test2", nil)).ShouldNot(Succeed(), "Should not update a non-existant region")
+		})
+
+		It("should reject queued tasks when the region is removed", func() {
+			doer := newRejectTestDoer(2)
+			_, err := lim.Enqueue(doer, reg)
+			Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+			plain := newTestDoer(4)
+			_, err = lim.Enqueue(plain, reg)
+			Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+			Ω(lim.RemoveRegion(reg)).Should(Succeed(), "Should be able to remove the region")
+			Eventually(doer.rejected).Should(Receive(Equal(ErrRegionRemoved)), "The queued task should be rejected")
+			_, retrieved := plain.popChannel(10)
+			Ω(retrieved).Should(BeFalse(), "The task which can't be rejected should be dropped")
+			_, err = lim.Enqueue(newTestDoer(3), reg)
+			Ω(err).Should(HaveOccurred(), "Should not be able to enqueue for a removed region")
+			Ω(lim.RemoveRegion(reg)).ShouldNot(Succeed(), "Should not be able to remove the region twice")
+		})
+
+		It("should match the regions and rates of a configuration", func() {
+			err := lim.Configure([]string{"EUW"}, []types.Rate{{Period: 10, Max: 4}},
+				map[string][]types.Rate{MethodGame: {{Period: 1, Max: 1}}})
+			Ω(err).ShouldNot(HaveOccurred(), "Configure shouldn't err here.")
+			metrics, err := lim.Metrics()
+			Ω(err).ShouldNot(HaveOccurred(), "Metrics shouldn't err here.")
+			Ω(metrics).Should(HaveLen(1), "Only the configured region should be left")
+			Ω(metrics[0].Region).Should(Equal("EUW"))
+			Ω(metrics[0].Allowance).Should(Equal(map[uint32]uint32{10: 4}))
+			Ω(metrics[0].MethodAllowance).Should(Equal(map[string]map[uint32]uint32{MethodGame: {1: 1}}))
+			err = lim.Configure([]string{"EUW"}, nil, nil)
+			Ω(err).ShouldNot(HaveOccurred(), "Configure shouldn't err here.")
+			metrics, _ = lim.Metrics()
+			Ω(metrics[0].MethodAllowance).Should(BeEmpty(), "Methods left out should have no rates")
+		})
+
+		It("should keep the limits reported by the server when reconfigured", func() {
+			Ω(lim.Reconcile(reg, map[uint32]uint32{600: 3, 20: 8}, nil)).Should(Succeed(), "Should be able to reconcile")
+			Ω(lim.ReconcileMethod(reg, MethodGame, map[uint32]uint32{1: 2, 120: 50}, nil)).Should(Succeed(), "Should be able to reconcile")
+			err := lim.Configure([]string{reg}, []types.Rate{{Period: 600, Max: 10}},
+				map[string][]types.Rate{MethodGame: {{Period: 1, Max: 5}}})
+			Ω(err).ShouldNot(HaveOccurred(), "Configure shouldn't err here.")
+			metrics, err := lim.Metrics()
+			Ω(err).ShouldNot(HaveOccurred(), "Metrics shouldn't err here.")
+			Ω(metrics[0].Allowance).Should(Equal(map[uint32]uint32{600: 1, 20: 6}), "Configured rates should be held to the reported limits")
+			Ω(metrics[0].MethodAllowance).Should(Equal(map[string]map[uint32]uint32{MethodGame: {1: 2, 120: 50}}))
+			Ω(lim.Configure([]string{reg}, nil, nil)).Should(Succeed(), "Configure shouldn't err here.")
+			metrics, _ = lim.Metrics()
+			Ω(metrics[0].Allowance).Should(Equal(map[uint32]uint32{600: 1, 20: 6}), "Reported limits should outlast the configured rates")
+		})
+	})
+
 	Context("When the limiter has been stopped", func() {
 		reg := "NA"
 		BeforeEach(func() {
 			err := lim.AddRegion(reg)
 			Ω(err).ShouldNot(HaveOccurred(), "Should be able to add region before stop.")
-			lim.Stop()
+			lim.Stop(context.Background(), RejectQueued)
 		})
 
 		It("should not allow further enqueueing", func() {
@@ -311,4 +1089,80 @@ var _ = Describe("Limiter", func() {
 			Ω(err).Should(HaveOccurred(), "Should not be able to add rates after stop")
 		})
 	})
+
+	Context("When the limiter is stopped with tasks queued", func() {
+		reg := "NA"
+		var first, queued *RejectTestDoer
+		var plain *TestDoer
+
+		BeforeEach(func() {
+			err := lim.AddRegion(reg)
+			Ω(err).ShouldNot(HaveOccurred(), "Should be able to add region before stop.")
+			lim.AddRate(1, 3, reg)
+			first = newRejectTestDoer(0)
+			_, err = lim.Enqueue(first, reg)
+			Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+			_, retrieved := first.wait(settleTime)
+			Ω(retrieved).Should(BeTrue(), "The first task should be performed immediately")
+			queued = newRejectTestDoer(1)
+			_, err = lim.Enqueue(queued, reg)
+			Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+			plain = newTestDoer(2)
+			_, err = lim.Enqueue(plain, reg)
+			Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+		})
+
+		//Stops the limiter in the background, as draining blocks until done.
+		stopAsync := func(ctx context.Context, mode StopMode) chan error {
+			ret := make(chan error, 1)
+			go func() {
+				ret <- lim.Stop(ctx, mode)
+			}()
+			Eventually(lim.Stopped).Should(BeTrue(), "The limiter should start stopping")
+			return ret
+		}
+
+		It("should reject queued tasks straight away when rejecting", func() {
+			err := lim.Stop(context.Background(), RejectQueued)
+			Ω(err).ShouldNot(HaveOccurred(), "Stop shouldn't err here.")
+			Ω(queued.rejected).Should(Receive(Equal(ErrLimiterStopped)), "The queued task should be rejected")
+			Ω(first.rejected).ShouldNot(Receive(), "The performed task should not be rejected")
+			_, retrieved := queued.popChannel(10)
+			Ω(retrieved).Should(BeFalse(), "The rejected task should never be performed")
+			_, retrieved = plain.popChannel(10)
+			Ω(retrieved).Should(BeFalse(), "The task which can't be rejected should be dropped")
+		})
+
+		It("should perform queued tasks within the rates when draining", func() {
+			stopped := stopAsync(context.Background(), DrainQueued)
+			_, err := lim.Enqueue(newTestDoer(3), reg)
+			Ω(err).Should(Equal(ErrLimiterStopped), "Should not be able to enqueue while draining")
+			_, retrieved := queued.popChannel(1)
+			Ω(retrieved).Should(BeFalse(), "Draining should still obey the rates")
+			_, retrieved = queued.popChannel(2)
+			Ω(retrieved).Should(BeTrue(), "The queued task should be performed while draining")
+			Ω(stopped).ShouldNot(Receive(), "Stop should wait for the rest of the queue")
+			_, retrieved = plain.popChannel(3)
+			Ω(retrieved).Should(BeTrue(), "The last queued task should be performed while draining")
+			Eventually(stopped).Should(Receive(BeNil()), "Stop should return once drained")
+			Ω(queued.rejected).ShouldNot(Receive(), "Nothing should have been rejected")
+		})
+
+		It("should reject what is left when the context is done while draining", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			stopped := stopAsync(ctx, DrainQueued)
+			cancel()
+			Eventually(stopped).Should(Receive(Equal(context.Canceled)), "Stop should give up draining")
+			Ω(queued.rejected).Should(Receive(Equal(ErrLimiterStopped)), "The queued task should be rejected")
+			_, retrieved := plain.popChannel(10)
+			Ω(retrieved).Should(BeFalse(), "The task which can't be rejected should be dropped")
+		})
+
+		It("should return straight away when draining with nothing queued", func() {
+			lim.Cancel(queued, reg)
+			lim.Cancel(plain, reg)
+			err := lim.Stop(context.Background(), DrainQueued)
+			Ω(err).ShouldNot(HaveOccurred(), "Stop shouldn't err here.")
+		})
+	})
 })
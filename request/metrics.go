@@ -0,0 +1,220 @@
+package request
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RegionMetrics is a snapshot of what a Limiter has done for one region.
+type RegionMetrics struct {
+	Region string
+	//The number of tasks waiting for allowance, for each priority
+	QueueDepth map[Priority]int
+	//The allowance left in each rate of the region, keyed by period
+	Allowance map[uint32]uint32
+	//The allowance left in each rate of each method of the region, keyed by
+	// method and then period. Methods without rates are left out.
+	MethodAllowance map[string]map[uint32]uint32
+	//The number of times tasks were performed and reached the server without
+	// being turned away for exceeding its rate limits. Tasks which were never
+	// sent, and throttled tasks, aren't counted.
+	Executed uint64
+	//The number of tasks turned away, either when enqueued or when the
+	// Limiter was stopped
+	Rejected uint64
+	//The number of tasks which the server turned away for exceeding its rate
+	// limits, as reported by ResultDoers
+	Throttled uint64
+	//How long tasks waited between being enqueued and being released
+	Wait Histogram
+}
+
+// Histogram is a snapshot of a distribution of durations.
+type Histogram struct {
+	//The upper bounds of the buckets, in seconds, in increasing order
+	Bounds []float64
+	//The number of durations within each bucket. Has one more entry than
+	// Bounds, for durations above the last bound.
+	Counts []uint64
+	//The sum of every duration, in seconds
+	Sum   float64
+	Count uint64
+}
+
+// waitBuckets are the bounds of the histogram of how long tasks wait for
+// allowance, in seconds. They go up to the longest period the API uses.
+var waitBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600}
+
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	h.counts[sort.SearchFloat64s(h.bounds, seconds)]++
+	h.sum += seconds
+	h.count++
+}
+
+func (h *histogram) snapshot() Histogram {
+	return Histogram{
+		Bounds: append([]float64(nil), h.bounds...),
+		Counts: append([]uint64(nil), h.counts...),
+		Sum:    h.sum,
+		Count:  h.count,
+	}
+}
+
+// Metrics reports on every region of this Limiter, ordered by region name.
+// Errs if the allowance left can't be had from the Limiter's RateStore.
+func (l *Limiter) Metrics() ([]RegionMetrics, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.clock.Now()
+	ret := make([]RegionMetrics, 0, len(l.regions))
+	for name, r := range l.regions {
+		allowance, err := l.allowance(&r.rates, now)
+		if err != nil {
+			return nil, err
+		}
+		metrics := RegionMetrics{
+			Region:          name,
+			QueueDepth:      r.queueDepth(),
+			Allowance:       allowance,
+			MethodAllowance: make(map[string]map[uint32]uint32),
+			Executed:        r.executed,
+			Rejected:        r.rejected,
+			Throttled:       r.throttled,
+			Wait:            r.wait.snapshot(),
+		}
+		for methodName, m := range r.methods {
+			if len(m.rates.rates) == 0 {
+				continue
+			}
+			if metrics.MethodAllowance[methodName], err = l.allowance(&m.rates, now); err != nil {
+				return nil, err
+			}
+		}
+		ret = append(ret, metrics)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Region < ret[j].Region
+	})
+	return ret, nil
+}
+
+// allowance asks the RateStore for the allowance left in each rate of the set,
+// keyed by period.
+func (l *Limiter) allowance(rs *rateSet, now time.Time) (map[uint32]uint32, error) {
+	remaining, err := l.store.Remaining(rs.limits(), now)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[uint32]uint32, len(rs.rates))
+	for i, rate := range rs.rates {
+		ret[rate.period] = remaining[i]
+	}
+	return ret, nil
+}
+
+// MetricsHandler returns an http.Handler which serves this Limiter's Metrics
+// in the Prometheus text format, for mounting at /metrics. Nothing is served
+// unless the caller mounts it.
+func (l *Limiter) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metrics, err := l.Metrics()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		buf := bufio.NewWriter(w)
+		writePrometheus(buf, metrics)
+		buf.Flush()
+	})
+}
+
+func writePrometheus(w *bufio.Writer, metrics []RegionMetrics) {
+	header := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	header("rpp_limiter_queue_depth", "gauge", "Tasks waiting for allowance.")
+	for _, m := range metrics {
+		for p := Priority(0); p < numPriorities; p++ {
+			fmt.Fprintf(w, "rpp_limiter_queue_depth{region=%s,priority=%s} %d\n",
+				label(m.Region), label(p.String()), m.QueueDepth[p])
+		}
+	}
+	header("rpp_limiter_allowance_remaining", "gauge", "Requests still allowed within each rate's period.")
+	for _, m := range metrics {
+		writeAllowance(w, m.Region, "", m.Allowance)
+		methods := make([]string, 0, len(m.MethodAllowance))
+		for method := range m.MethodAllowance {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+		for _, method := range methods {
+			writeAllowance(w, m.Region, method, m.MethodAllowance[method])
+		}
+	}
+	header("rpp_limiter_tasks_executed_total", "counter", "Tasks performed which reached the server without being throttled.")
+	for _, m := range metrics {
+		fmt.Fprintf(w, "rpp_limiter_tasks_executed_total{region=%s} %d\n", label(m.Region), m.Executed)
+	}
+	header("rpp_limiter_tasks_rejected_total", "counter", "Tasks turned away by the limiter.")
+	for _, m := range metrics {
+		fmt.Fprintf(w, "rpp_limiter_tasks_rejected_total{region=%s} %d\n", label(m.Region), m.Rejected)
+	}
+	header("rpp_limiter_tasks_throttled_total", "counter", "Tasks turned away by the server for exceeding its rate limits.")
+	for _, m := range metrics {
+		fmt.Fprintf(w, "rpp_limiter_tasks_throttled_total{region=%s} %d\n", label(m.Region), m.Throttled)
+	}
+	header("rpp_limiter_queue_wait_seconds", "histogram", "Time tasks spent waiting for allowance.")
+	for _, m := range metrics {
+		region := label(m.Region)
+		var cumulative uint64
+		for i, bound := range m.Wait.Bounds {
+			cumulative += m.Wait.Counts[i]
+			fmt.Fprintf(w, "rpp_limiter_queue_wait_seconds_bucket{region=%s,le=%s} %d\n",
+				region, label(strconv.FormatFloat(bound, 'g', -1, 64)), cumulative)
+		}
+		fmt.Fprintf(w, "rpp_limiter_queue_wait_seconds_bucket{region=%s,le=\"+Inf\"} %d\n", region, m.Wait.Count)
+		fmt.Fprintf(w, "rpp_limiter_queue_wait_seconds_sum{region=%s} %s\n",
+			region, strconv.FormatFloat(m.Wait.Sum, 'g', -1, 64))
+		fmt.Fprintf(w, "rpp_limiter_queue_wait_seconds_count{region=%s} %d\n", region, m.Wait.Count)
+	}
+}
+
+func writeAllowance(w *bufio.Writer, region, method string, allowance map[uint32]uint32) {
+	periods := make([]int, 0, len(allowance))
+	for period := range allowance {
+		periods = append(periods, int(period))
+	}
+	sort.Ints(periods)
+	for _, period := range periods {
+		fmt.Fprintf(w, "rpp_limiter_allowance_remaining{region=%s,method=%s,period=\"%d\"} %d\n",
+			label(region), label(method), period, allowance[uint32(period)])
+	}
+}
+
+// labelEscaper escapes a label value for the Prometheus text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func label(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
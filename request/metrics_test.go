@@ -0,0 +1,87 @@
+package request_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/thomasmmitchell/recentlyplayedplus/request"
+	"github.com/thomasmmitchell/recentlyplayedplus/request/fakeclock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Limiter metrics", func() {
+	var lim *Limiter
+	reg := "NA"
+
+	BeforeEach(func() {
+		clock = fakeclock.New(time.Date(2016, time.June, 1, 0, 0, 0, 0, time.UTC))
+		lim = NewLimiterWithClock(clock)
+		Ω(lim.AddRegion(reg)).Should(Succeed(), "Should be able to add a region")
+		Ω(lim.AddRate(2, 10, reg)).Should(Succeed(), "Should be able to add a rate")
+		Ω(lim.AddMethodRate(5, 1, reg, MethodGame)).Should(Succeed(), "Should be able to add a method rate")
+		for i := 0; i < 3; i++ {
+			_, err := lim.EnqueueMethod(newTestDoer(i), reg, MethodGame)
+			Ω(err).ShouldNot(HaveOccurred(), "Enqueue shouldn't err here.")
+		}
+		Eventually(func() uint64 {
+			metrics, _ := lim.Metrics()
+			return metrics[0].Executed
+		}).Should(BeEquivalentTo(2), "The allowed tasks should complete")
+	})
+
+	AfterEach(func() {
+		lim.Stop(context.Background(), RejectQueued)
+	})
+
+	It("should report on each region", func() {
+		metrics, err := lim.Metrics()
+		Ω(err).ShouldNot(HaveOccurred(), "Metrics shouldn't err here.")
+		Ω(metrics).Should(HaveLen(1), "There should be one region")
+		m := metrics[0]
+		Ω(m.Region).Should(Equal(reg))
+		Ω(m.QueueDepth).Should(Equal(map[Priority]int{PriorityInteractive: 0, PriorityNormal: 1, PriorityBackground: 0}))
+		Ω(m.Allowance).Should(Equal(map[uint32]uint32{10: 0}))
+		Ω(m.MethodAllowance).Should(Equal(map[string]map[uint32]uint32{MethodGame: {1: 3}}))
+		Ω(m.Rejected).Should(BeZero())
+		Ω(m.Wait.Count).Should(BeEquivalentTo(2), "Released tasks should have their wait recorded")
+	})
+
+	It("should record how long queued tasks waited", func() {
+		clock.Advance(10 * time.Second)
+		Eventually(func() uint64 {
+			metrics, _ := lim.Metrics()
+			return metrics[0].Executed
+		}).Should(BeEquivalentTo(3), "The queued task should complete")
+		metrics, err := lim.Metrics()
+		Ω(err).ShouldNot(HaveOccurred(), "Metrics shouldn't err here.")
+		Ω(metrics[0].Wait.Sum).Should(BeNumerically("==", 10))
+		Ω(metrics[0].Wait.Counts[0]).Should(BeEquivalentTo(2), "Tasks released straight away didn't wait")
+		Ω(metrics[0].Wait.Counts[6]).Should(BeEquivalentTo(1), "The queued task waited ten seconds")
+	})
+
+	It("should count tasks rejected when stopped", func() {
+		lim.Stop(context.Background(), RejectQueued)
+		metrics, err := lim.Metrics()
+		Ω(err).ShouldNot(HaveOccurred(), "Metrics shouldn't err here.")
+		Ω(metrics[0].Rejected).Should(BeEquivalentTo(1))
+	})
+
+	It("should serve them in the Prometheus text format", func() {
+		recorder := httptest.NewRecorder()
+		lim.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		Ω(recorder.Code).Should(Equal(200))
+		body, _ := ioutil.ReadAll(recorder.Body)
+		Ω(string(body)).Should(ContainSubstring("# TYPE rpp_limiter_queue_depth gauge\n"))
+		Ω(string(body)).Should(ContainSubstring(`rpp_limiter_queue_depth{region="NA",priority="normal"} 1` + "\n"))
+		Ω(string(body)).Should(ContainSubstring(`rpp_limiter_allowance_remaining{region="NA",method="",period="10"} 0` + "\n"))
+		Ω(string(body)).Should(ContainSubstring(`rpp_limiter_allowance_remaining{region="NA",method="game",period="1"} 3` + "\n"))
+		Ω(string(body)).Should(ContainSubstring(`rpp_limiter_tasks_executed_total{region="NA"} 2` + "\n"))
+		Ω(string(body)).Should(ContainSubstring(`rpp_limiter_queue_wait_seconds_bucket{region="NA",le="0.01"} 2` + "\n"))
+		Ω(string(body)).Should(ContainSubstring(`rpp_limiter_queue_wait_seconds_bucket{region="NA",le="+Inf"} 2` + "\n"))
+		Ω(string(body)).Should(ContainSubstring(`rpp_limiter_queue_wait_seconds_count{region="NA"} 2` + "\n"))
+	})
+})
@@ -0,0 +1,187 @@
+package request
+
+import (
+	"context"
+	"time"
+)
+
+// Priority decides which queued tasks get to use allowance first when there is
+// not enough of it for all of them.
+type Priority int
+
+const (
+	// PriorityInteractive is for tasks that somebody is waiting on right now.
+	PriorityInteractive Priority = iota
+	// PriorityNormal is for everyday tasks, and is the default.
+	PriorityNormal
+	// PriorityBackground is for bulk work that can wait, such as crawls.
+	PriorityBackground
+
+	numPriorities = 3
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityInteractive:
+		return "interactive"
+	case PriorityNormal:
+		return "normal"
+	case PriorityBackground:
+		return "background"
+	}
+	return "unknown"
+}
+
+func (p Priority) valid() bool {
+	return p >= 0 && p < numPriorities
+}
+
+// DequeuePolicy decides the order in which a Limiter releases queued tasks of
+// different priorities.
+type DequeuePolicy int
+
+const (
+	// StrictPriority always releases the highest priority task waiting. Lower
+	// priorities only get the allowance that higher priorities don't need, so
+	// they can starve. This is the default.
+	StrictPriority DequeuePolicy = iota
+	// WeightedFair releases tasks of each waiting priority in proportion to the
+	// priority's weight, so that every priority makes progress.
+	WeightedFair
+)
+
+// priorityWeights are the shares of allowance each priority gets under
+// WeightedFair, indexed by Priority.
+var priorityWeights = [numPriorities]int{4, 2, 1}
+
+// lanes queue tasks waiting on a Limiter in a FIFO queue for each priority.
+// Like taskQueue, it is not synchronized.
+type lanes struct {
+	queues [numPriorities]*taskQueue
+	//Running tally for the smooth weighted round robin of WeightedFair
+	credit [numPriorities]int
+}
+
+func newLanes() *lanes {
+	ret := &lanes{}
+	for i := range ret.queues {
+		ret.queues[i] = newTaskQueue()
+	}
+	return ret
+}
+
+func (ls *lanes) push(task LimitedDoer, p Priority, since time.Time) {
+	ls.queues[p].push(queued{task: task, priority: p, since: since})
+}
+
+func (ls *lanes) pushFront(task LimitedDoer, p Priority, since time.Time) {
+	ls.queues[p].pushFront(queued{task: task, priority: p, since: since})
+}
+
+func (ls *lanes) remove(task LimitedDoer) bool {
+	_, ok := ls.take(task)
+	return ok
+}
+
+// take removes task from whichever lane it is queued in and returns it.
+// Returns false if the task isn't queued.
+func (ls *lanes) take(task LimitedDoer) (queued, bool) {
+	for _, q := range ls.queues {
+		if t, ok := q.remove(task); ok {
+			return t, true
+		}
+	}
+	return queued{}, false
+}
+
+// move puts a queued task at the back of the lane for p, keeping the time it
+// started waiting. Returns false if the task isn't queued.
+func (ls *lanes) move(task LimitedDoer, p Priority) bool {
+	t, ok := ls.take(task)
+	if ok {
+		ls.push(task, p, t.since)
+	}
+	return ok
+}
+
+func (ls *lanes) empty() bool {
+	return ls.len() == 0
+}
+
+func (ls *lanes) len() (total int) {
+	for _, q := range ls.queues {
+		total += q.len()
+	}
+	return total
+}
+
+// poll removes and returns the next task to release under the given policy. The
+// task is nil if no tasks are waiting.
+func (ls *lanes) poll(policy DequeuePolicy) queued {
+	p, ok := nextPriority(policy, &ls.credit, ls.waiting)
+	if !ok {
+		return queued{}
+	}
+	return ls.queues[p].poll()
+}
+
+// pollPriority removes and returns the task at the head of the lane for p. The
+// task is nil if none are waiting at that priority.
+func (ls *lanes) pollPriority(p Priority) queued {
+	return ls.queues[p].poll()
+}
+
+// waiting is true if there are tasks queued at priority p.
+func (ls *lanes) waiting(p Priority) bool {
+	return ls.queues[p].len() > 0
+}
+
+// nextPriority picks the priority to release a task of next under policy, out
+// of those for which waiting is true. Returns false if there are none. credit
+// is the running tally for the smooth weighted round robin of WeightedFair:
+// every waiting priority earns its weight in credit, and the priority with the
+// most credit is served and pays back the total earned.
+func nextPriority(policy DequeuePolicy, credit *[numPriorities]int, waiting func(Priority) bool) (Priority, bool) {
+	if policy != WeightedFair {
+		for p := Priority(0); p < numPriorities; p++ {
+			if waiting(p) {
+				return p, true
+			}
+		}
+		return 0, false
+	}
+	best, total := Priority(-1), 0
+	for p := Priority(0); p < numPriorities; p++ {
+		if !waiting(p) {
+			credit[p] = 0
+			continue
+		}
+		credit[p] += priorityWeights[p]
+		total += priorityWeights[p]
+		if best < 0 || credit[p] > credit[best] {
+			best = p
+		}
+	}
+	if best < 0 {
+		return 0, false
+	}
+	credit[best] -= total
+	return best, true
+}
+
+type priorityKey struct{}
+
+// WithPriority returns a copy of ctx which makes requests fetched with it
+// queue at the given priority.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// priorityFrom returns the priority set on ctx by WithPriority, defaulting to
+// PriorityNormal.
+func priorityFrom(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok && p.valid() {
+		return p
+	}
+	return PriorityNormal
+}
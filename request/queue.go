@@ -0,0 +1,64 @@
+package request
+
+import "time"
+
+// taskQueue is a FIFO queue of tasks waiting on a Limiter. It is not
+// synchronized; the Limiter's lock guards every access to it.
+type taskQueue struct {
+	tasks []queued
+}
+
+// queued is a task waiting in a taskQueue, along with its priority and when it
+// started waiting.
+type queued struct {
+	task     LimitedDoer
+	priority Priority
+	since    time.Time
+}
+
+func newTaskQueue() *taskQueue {
+	return &taskQueue{}
+}
+
+func (q *taskQueue) push(task queued) {
+	q.tasks = append(q.tasks, task)
+}
+
+// pushFront puts task at the head of the queue, ahead of everything already
+// waiting.
+func (q *taskQueue) pushFront(task queued) {
+	q.tasks = append(q.tasks, queued{})
+	copy(q.tasks[1:], q.tasks)
+	q.tasks[0] = task
+}
+
+// poll removes and returns the task at the head of the queue. The task is nil
+// if the queue is empty.
+func (q *taskQueue) poll() queued {
+	if len(q.tasks) == 0 {
+		return queued{}
+	}
+	task := q.tasks[0]
+	q.tasks[0] = queued{}
+	q.tasks = q.tasks[1:]
+	return task
+}
+
+// remove takes the first occurrence of task out of the queue, preserving the
+// order of everything else, and returns it. Returns false if the task wasn't
+// queued.
+func (q *taskQueue) remove(task LimitedDoer) (queued, bool) {
+	for i, t := range q.tasks {
+		if t.task == task {
+			copy(q.tasks[i:], q.tasks[i+1:])
+			q.tasks[len(q.tasks)-1] = queued{}
+			q.tasks = q.tasks[:len(q.tasks)-1]
+			return t, true
+		}
+	}
+	return queued{}, false
+}
+
+func (q *taskQueue) len() int {
+	return len(q.tasks)
+}
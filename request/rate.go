@@ -0,0 +1,189 @@
+package request
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/thomasmmitchell/recentlyplayedplus/types"
+)
+
+// rate is a limit on the number of requests that can occur within a period.
+// The requests counted against it are kept by the Limiter's RateStore.
+type rate struct {
+	// Number of seconds within which the max requests can occur
+	period uint32
+	// The maximum number of requests that can occur within the period
+	max uint32
+}
+
+// rateSet is a group of rates which must all have allowance for a task to be
+// performed. The requests counted against them are kept under key in the
+// Limiter's RateStore.
+type rateSet struct {
+	key   string
+	rates []*rate
+	//The limits last reported by the server for this set, keyed by period
+	learned map[uint32]uint32
+}
+
+// add creates a rate in this set. Requests already counted against the set
+// are carried over to the new rate from whichever rate has the longest period,
+// so that it doesn't start out believing its full allowance is available.
+func (rs *rateSet) add(limit, period uint32, store RateStore, now time.Time) error {
+	var from *rate
+	for _, rate := range rs.rates {
+		if from == nil || longer(rate.period, from.period) {
+			from = rate
+		}
+	}
+	newRate := &rate{
+		period: period,
+		max:    limit,
+	}
+	rs.rates = append(rs.rates, newRate)
+	if from == nil {
+		return nil
+	}
+	return store.Seed(newRate.limit(rs.key), from.limit(rs.key), now)
+}
+
+// replace makes the rates of this set those given. Rates with a period which
+// is already in the set keep the requests counted against them, and new rates
+// are added as by add. The limits learned from the server by reconcile still
+// apply on top of the rates given, as the server goes on enforcing them. Errs
+// if more than one rate has the same period.
+func (rs *rateSet) replace(rates []types.Rate, store RateStore, now time.Time) error {
+	seen := make(map[uint32]bool, len(rates))
+	for _, r := range rates {
+		if seen[r.Period] {
+			return fmt.Errorf("More than one rate with a period of %d", r.Period)
+		}
+		seen[r.Period] = true
+	}
+	for _, r := range rates {
+		if existing := rs.rateFor(r.Period); existing != nil {
+			existing.max = r.Max
+		} else if err := rs.add(r.Max, r.Period, store, now); err != nil {
+			return err
+		}
+	}
+	for period, max := range rs.learned {
+		r := rs.rateFor(period)
+		switch {
+		case r == nil:
+			if err := rs.add(max, period, store, now); err != nil {
+				return err
+			}
+		case seen[period]:
+			r.tighten(max)
+		default:
+			//A rate which is no longer configured is kept for the server's limit
+			r.max = max
+		}
+		seen[period] = true
+	}
+	kept := rs.rates[:0]
+	for _, rate := range rs.rates {
+		if seen[rate.period] {
+			kept = append(kept, rate)
+		}
+	}
+	rs.rates = kept
+	return nil
+}
+
+// longer is true if period a is longer than period b, where a period of zero
+// is longer than any other.
+func longer(a, b uint32) bool {
+	if a == 0 || b == 0 {
+		return a == 0 && b != 0
+	}
+	return a > b
+}
+
+// rateFor returns the rate in this set with the given period, or nil if there
+// is none.
+func (rs *rateSet) rateFor(period uint32) *rate {
+	for _, rate := range rs.rates {
+		if rate.period == period {
+			return rate
+		}
+	}
+	return nil
+}
+
+// hasZeroPeriod is true if any rate in this set never has its allowance
+// replenished.
+func (rs *rateSet) hasZeroPeriod() bool {
+	for _, rate := range rs.rates {
+		if rate.period == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// shortestPeriod is the shortest period of the rates in this set which have
+// their allowance replenished, or zero if none do.
+func (rs *rateSet) shortestPeriod() uint32 {
+	var ret uint32
+	for _, rate := range rs.rates {
+		if rate.period != 0 && (ret == 0 || rate.period < ret) {
+			ret = rate.period
+		}
+	}
+	return ret
+}
+
+// limits describes the rates of this set to a RateStore.
+func (rs *rateSet) limits() []Limit {
+	ret := make([]Limit, 0, len(rs.rates))
+	for _, rate := range rs.rates {
+		ret = append(ret, rate.limit(rs.key))
+	}
+	return ret
+}
+
+// reconcile applies limits and counts reported by the server, both keyed by
+// period, to this set and the requests the store has counted against it. See
+// Limiter.Reconcile.
+func (rs *rateSet) reconcile(limits, counts map[uint32]uint32, store RateStore, now time.Time) error {
+	for period, max := range limits {
+		if period == 0 {
+			continue
+		}
+		if rs.learned == nil {
+			rs.learned = make(map[uint32]uint32)
+		}
+		rs.learned[period] = max
+		if r := rs.rateFor(period); r != nil {
+			r.tighten(max)
+		} else if err := rs.add(max, period, store, now); err != nil {
+			return err
+		}
+	}
+	for period, count := range counts {
+		if r := rs.rateFor(period); r != nil && period != 0 {
+			if err := store.Observe(r.limit(rs.key), count, now); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *rate) limit(key string) Limit {
+	return Limit{
+		Key:    key,
+		Period: r.period,
+		Max:    r.max,
+	}
+}
+
+// tighten lowers the max of this rate. Has no effect if max isn't lower than
+// the current max.
+func (r *rate) tighten(max uint32) {
+	if max < r.max {
+		r.max = max
+	}
+}
@@ -0,0 +1,141 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/thomasmmitchell/recentlyplayedplus/types"
+)
+
+// ErrRegionRemoved is given to the queued tasks of a region which is removed
+// from a Limiter.
+var ErrRegionRemoved = errors.New("Region has been removed")
+
+// RemoveRegion unregisters the region with the given name from this Limiter.
+// The tasks queued for it are rejected with ErrRegionRemoved, as are tasks
+// already released which ask to be requeued. Those which can't be rejected are
+// dropped; see RejectableDoer. Tasks which have already been released are still
+// performed. Errs if the region doesn't exist or if the Limiter has been
+// stopped.
+func (l *Limiter) RemoveRegion(name string) error {
+	l.lock.Lock()
+	if l.isStopping {
+		l.lock.Unlock()
+		return ErrLimiterStopped
+	}
+	rejected, err := l.removeRegion(name)
+	l.update()
+	l.lock.Unlock()
+	rejectAll(rejected, ErrRegionRemoved)
+	return err
+}
+
+func (l *Limiter) removeRegion(name string) ([]LimitedDoer, error) {
+	reg, ok := l.regions[name]
+	if !ok {
+		return nil, fmt.Errorf("Cannot remove unknown region '%s'", name)
+	}
+	delete(l.regions, name)
+	return reg.dropQueued(), nil
+}
+
+// UpdateRates makes the rates of the given region those given, in place of the
+// rates it has. Rates which keep their period keep the requests counted
+// against them, even if their max changes, and new rates start out with the
+// requests counted against the rates they replace, as with AddRate. The limits
+// last reported for the region to Reconcile still hold: a rate given with a
+// higher max is held down to the reported limit, and a reported limit for a
+// period which isn't given is kept as a rate. Errs if more than one rate has
+// the same period, if the region doesn't exist, or if the Limiter has been
+// stopped.
+func (l *Limiter) UpdateRates(region string, rates []types.Rate) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.isStopping {
+		return ErrLimiterStopped
+	}
+	reg, ok := l.regions[region]
+	if !ok {
+		return fmt.Errorf("Cannot update rates for unknown region '%s'", region)
+	}
+	err := reg.rates.replace(rates, l.store, l.clock.Now())
+	l.update()
+	return err
+}
+
+// UpdateMethodRates is UpdateRates for the rates of a method of the given
+// region. The method is created if it doesn't already exist.
+func (l *Limiter) UpdateMethodRates(region, method string, rates []types.Rate) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.isStopping {
+		return ErrLimiterStopped
+	}
+	reg, ok := l.regions[region]
+	if !ok {
+		return fmt.Errorf("Cannot update rates for unknown region '%s'", region)
+	}
+	err := reg.method(method).rates.replace(rates, l.store, l.clock.Now())
+	l.update()
+	return err
+}
+
+// Configure brings the regions of this Limiter and their rates in line with
+// those given, such as those of a configuration file which has just been
+// reloaded. Regions which aren't given are removed as by RemoveRegion, and
+// every region given is added if need be and has its rates, and the rates of
+// each of the methods given, updated as by UpdateRates. Methods of a region
+// which aren't given are left with no rates of their own, other than those
+// reported to ReconcileMethod. Errs if a region is named twice, if a set of
+// rates has more than one rate with the same period, or if the Limiter has
+// been stopped. Regions are still updated as far as possible when it errs.
+func (l *Limiter) Configure(regions []string, rates []types.Rate, methods map[string][]types.Rate) error {
+	l.lock.Lock()
+	if l.isStopping {
+		l.lock.Unlock()
+		return ErrLimiterStopped
+	}
+	var errs []string
+	wanted := make(map[string]bool, len(regions))
+	for _, name := range regions {
+		if wanted[name] {
+			errs = append(errs, fmt.Sprintf("region '%s' is given more than once", name))
+		}
+		wanted[name] = true
+	}
+	var rejected []LimitedDoer
+	for name := range l.regions {
+		if !wanted[name] {
+			removed, _ := l.removeRegion(name)
+			rejected = append(rejected, removed...)
+		}
+	}
+	now := l.clock.Now()
+	for name := range wanted {
+		if _, ok := l.regions[name]; !ok {
+			l.addRegion(name)
+		}
+		reg := l.regions[name]
+		if err := reg.rates.replace(rates, l.store, now); err != nil {
+			errs = append(errs, fmt.Sprintf("region '%s': %s", name, err))
+		}
+		for methodName, m := range reg.methods {
+			if _, ok := methods[methodName]; !ok {
+				m.rates.replace(nil, l.store, now)
+			}
+		}
+		for methodName, methodRates := range methods {
+			if err := reg.method(methodName).rates.replace(methodRates, l.store, now); err != nil {
+				errs = append(errs, fmt.Sprintf("method '%s' of region '%s': %s", methodName, name, err))
+			}
+		}
+	}
+	l.update()
+	l.lock.Unlock()
+	rejectAll(rejected, ErrRegionRemoved)
+	if len(errs) > 0 {
+		return fmt.Errorf("Could not configure limiter: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,515 @@
+// Package fakeredis provides a server speaking just enough of the Redis
+// protocol (RESP) to serve the commands redisstore sends: the sorted set
+// commands it counts requests with, and WATCH, MULTI and EXEC, which it makes
+// them atomic with. It lets the store be tested without a Redis server.
+// Keys are never expired, as the store's tests run on a clock of their own.
+package fakeredis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server is a fake Redis server listening on a local TCP port. Server is safe
+// for concurrent use.
+type Server struct {
+	listener net.Listener
+	lock     sync.Mutex
+	sets     map[string]map[string]float64
+	//Bumped whenever a key is written, for WATCH. Kept after a key is deleted,
+	// so that deleting a watched key is noticed.
+	versions map[string]uint64
+	conns    map[net.Conn]bool
+	wg       sync.WaitGroup
+}
+
+// client holds the transaction state of one connection.
+type client struct {
+	//The version of each watched key when it was watched
+	watched map[string]uint64
+	inMulti bool
+	queued  [][]string
+}
+
+// Start starts a Server on a free local port. Close it once it is no longer
+// needed.
+func Start() (*Server, error) {
+	return StartAddr("127.0.0.1:0")
+}
+
+// StartAddr starts a Server listening on addr, given as host:port, such as
+// the address of a Server which has been closed.
+func StartAddr(addr string) (*Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		listener: l,
+		sets:     make(map[string]map[string]float64),
+		versions: make(map[string]uint64),
+		conns:    make(map[net.Conn]bool),
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// Addr is the address the server listens on, as host:port.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the server, dropping every connection to it and everything it
+// holds.
+func (s *Server) Close() {
+	s.listener.Close()
+	s.lock.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.lock.Unlock()
+	s.wg.Wait()
+}
+
+// Keys returns the keys the server holds, in order.
+func (s *Server) Keys() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ret := make([]string, 0, len(s.sets))
+	for key := range s.sets {
+		ret = append(ret, key)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.conns[c] = true
+		s.lock.Unlock()
+		s.wg.Add(1)
+		go s.serve(c)
+	}
+}
+
+func (s *Server) serve(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, c)
+		s.lock.Unlock()
+		c.Close()
+	}()
+	r := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+	cl := &client{}
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		reply := s.handle(cl, args)
+		s.lock.Unlock()
+		writeReply(w, reply)
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// readCommand reads a command sent as an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return nil, fmt.Errorf("Expected an array, got '%s'", line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("Bad array length '%s'", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err = readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("Expected a bulk string, got '%s'", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("Bad bulk string length '%s'", line)
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\r\n"), nil
+}
+
+// The replies handle gives, besides string, int64, []interface{} and nil,
+// which are sent as a simple string, an integer, an array and a null bulk
+// string respectively.
+type (
+	replyError string
+	bulk       string
+	nullArray  struct{}
+)
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch r := reply.(type) {
+	case string:
+		fmt.Fprintf(w, "+%s\r\n", r)
+	case replyError:
+		fmt.Fprintf(w, "-%s\r\n", r)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", r)
+	case bulk:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(r), r)
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(r))
+		for _, v := range r {
+			writeReply(w, v)
+		}
+	case nullArray:
+		fmt.Fprint(w, "*-1\r\n")
+	case nil:
+		fmt.Fprint(w, "$-1\r\n")
+	}
+}
+
+func wrongArgs(cmd string) replyError {
+	return replyError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+}
+
+// handle runs a command sent by cl, or queues it if cl is in a transaction.
+// Must be called with the lock held.
+func (s *Server) handle(cl *client, args []string) interface{} {
+	cmd := strings.ToUpper(args[0])
+	switch cmd {
+	case "MULTI":
+		if cl.inMulti {
+			return replyError("ERR MULTI calls can not be nested")
+		}
+		cl.inMulti = true
+		return "OK"
+	case "EXEC":
+		if !cl.inMulti {
+			return replyError("ERR EXEC without MULTI")
+		}
+		queued, watched := cl.queued, cl.watched
+		*cl = client{}
+		for key, version := range watched {
+			if s.versions[key] != version {
+				return nullArray{}
+			}
+		}
+		ret := make([]interface{}, len(queued))
+		for i, args := range queued {
+			ret[i] = s.run(args)
+		}
+		return ret
+	case "DISCARD":
+		if !cl.inMulti {
+			return replyError("ERR DISCARD without MULTI")
+		}
+		*cl = client{}
+		return "OK"
+	case "WATCH":
+		if cl.inMulti {
+			return replyError("ERR WATCH inside MULTI is not allowed")
+		}
+		if len(args) < 2 {
+			return wrongArgs(cmd)
+		}
+		if cl.watched == nil {
+			cl.watched = make(map[string]uint64)
+		}
+		for _, key := range args[1:] {
+			if _, ok := cl.watched[key]; !ok {
+				cl.watched[key] = s.versions[key]
+			}
+		}
+		return "OK"
+	case "UNWATCH":
+		cl.watched = nil
+		return "OK"
+	}
+	handler, ok := commands[cmd]
+	if !ok {
+		return replyError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+	if len(args) < handler.minArgs {
+		return wrongArgs(cmd)
+	}
+	if cl.inMulti {
+		cl.queued = append(cl.queued, args)
+		return "QUEUED"
+	}
+	return s.run(args)
+}
+
+// run runs a command other than those handling transactions, which is known
+// to exist and to have been given enough arguments.
+func (s *Server) run(args []string) interface{} {
+	return commands[strings.ToUpper(args[0])].run(s, args[1:])
+}
+
+type command struct {
+	//Including the name of the command
+	minArgs int
+	run     func(s *Server, args []string) interface{}
+}
+
+var commands = map[string]command{
+	"ZADD":             {4, (*Server).zadd},
+	"ZREM":             {3, (*Server).zrem},
+	"ZCOUNT":           {4, (*Server).zcount},
+	"ZRANGEBYSCORE":    {4, (*Server).zrangebyscore},
+	"ZREMRANGEBYSCORE": {4, (*Server).zremrangebyscore},
+	"PEXPIRE":          {3, (*Server).pexpire},
+	"DEL":              {2, (*Server).del},
+}
+
+// touch marks key as written, failing the transactions watching it.
+func (s *Server) touch(key string) {
+	s.versions[key]++
+}
+
+// ZADD key [XX|NX] score member [score member ...]
+func (s *Server) zadd(args []string) interface{} {
+	key := args[0]
+	args = args[1:]
+	xx, nx := false, false
+	for len(args) > 0 && (strings.EqualFold(args[0], "XX") || strings.EqualFold(args[0], "NX")) {
+		if strings.EqualFold(args[0], "XX") {
+			xx = true
+		} else {
+			nx = true
+		}
+		args = args[1:]
+	}
+	if len(args) == 0 || len(args)%2 != 0 || (xx && nx) {
+		return replyError("ERR syntax error")
+	}
+	scores := make([]float64, len(args)/2)
+	for i := range scores {
+		var err error
+		if scores[i], err = strconv.ParseFloat(args[i*2], 64); err != nil {
+			return replyError("ERR value is not a valid float")
+		}
+	}
+	set := s.sets[key]
+	added, changed := int64(0), false
+	for i, score := range scores {
+		member := args[i*2+1]
+		old, exists := set[member]
+		if (xx && !exists) || (nx && exists) || (exists && old == score) {
+			continue
+		}
+		if set == nil {
+			set = make(map[string]float64)
+			s.sets[key] = set
+		}
+		set[member] = score
+		changed = true
+		if !exists {
+			added++
+		}
+	}
+	if changed {
+		s.touch(key)
+	}
+	return added
+}
+
+// ZREM key member [member ...]
+func (s *Server) zrem(args []string) interface{} {
+	set := s.sets[args[0]]
+	removed := int64(0)
+	for _, member := range args[1:] {
+		if _, ok := set[member]; ok {
+			delete(set, member)
+			removed++
+		}
+	}
+	if removed > 0 {
+		s.removed(args[0])
+	}
+	return removed
+}
+
+// ZCOUNT key min max
+func (s *Server) zcount(args []string) interface{} {
+	members, err := s.inRange(args[0], args[1], args[2])
+	if err != nil {
+		return replyError(err.Error())
+	}
+	return int64(len(members))
+}
+
+// ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count]
+func (s *Server) zrangebyscore(args []string) interface{} {
+	members, err := s.inRange(args[0], args[1], args[2])
+	if err != nil {
+		return replyError(err.Error())
+	}
+	withScores := false
+	for opts := args[3:]; len(opts) > 0; {
+		switch strings.ToUpper(opts[0]) {
+		case "WITHSCORES":
+			withScores = true
+			opts = opts[1:]
+		case "LIMIT":
+			if len(opts) < 3 {
+				return replyError("ERR syntax error")
+			}
+			offset, err1 := strconv.Atoi(opts[1])
+			count, err2 := strconv.Atoi(opts[2])
+			if err1 != nil || err2 != nil || offset < 0 {
+				return replyError("ERR value is not an integer or out of range")
+			}
+			if offset > len(members) {
+				offset = len(members)
+			}
+			members = members[offset:]
+			if count >= 0 && count < len(members) {
+				members = members[:count]
+			}
+			opts = opts[3:]
+		default:
+			return replyError("ERR syntax error")
+		}
+	}
+	ret := make([]interface{}, 0, len(members)*2)
+	for _, m := range members {
+		ret = append(ret, bulk(m.member))
+		if withScores {
+			ret = append(ret, bulk(formatScore(m.score)))
+		}
+	}
+	return ret
+}
+
+// ZREMRANGEBYSCORE key min max
+func (s *Server) zremrangebyscore(args []string) interface{} {
+	members, err := s.inRange(args[0], args[1], args[2])
+	if err != nil {
+		return replyError(err.Error())
+	}
+	for _, m := range members {
+		delete(s.sets[args[0]], m.member)
+	}
+	if len(members) > 0 {
+		s.removed(args[0])
+	}
+	return int64(len(members))
+}
+
+// PEXPIRE key milliseconds
+func (s *Server) pexpire(args []string) interface{} {
+	if _, err := strconv.ParseInt(args[1], 10, 64); err != nil {
+		return replyError("ERR value is not an integer or out of range")
+	}
+	if _, ok := s.sets[args[0]]; !ok {
+		return int64(0)
+	}
+	s.touch(args[0])
+	return int64(1)
+}
+
+// DEL key [key ...]
+func (s *Server) del(args []string) interface{} {
+	deleted := int64(0)
+	for _, key := range args {
+		if _, ok := s.sets[key]; ok {
+			delete(s.sets, key)
+			s.touch(key)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// removed marks key as written after members were removed from it, deleting
+// it if it is now empty, as Redis does.
+func (s *Server) removed(key string) {
+	if len(s.sets[key]) == 0 {
+		delete(s.sets, key)
+	}
+	s.touch(key)
+}
+
+type scored struct {
+	member string
+	score  float64
+}
+
+// inRange returns the members of the sorted set at key with scores between
+// min and max, ordered by score and then by member.
+func (s *Server) inRange(key, min, max string) ([]scored, error) {
+	lo, loExclusive, err := parseBound(min)
+	if err != nil {
+		return nil, err
+	}
+	hi, hiExclusive, err := parseBound(max)
+	if err != nil {
+		return nil, err
+	}
+	var ret []scored
+	for member, score := range s.sets[key] {
+		if score < lo || (loExclusive && score == lo) || score > hi || (hiExclusive && score == hi) {
+			continue
+		}
+		ret = append(ret, scored{member: member, score: score})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].score != ret[j].score {
+			return ret[i].score < ret[j].score
+		}
+		return ret[i].member < ret[j].member
+	})
+	return ret, nil
+}
+
+// parseBound reads the min or max of a score range, such as "-inf", "5" or
+// "(5", where the parenthesis makes the bound exclusive.
+func parseBound(bound string) (float64, bool, error) {
+	exclusive := strings.HasPrefix(bound, "(")
+	value, err := strconv.ParseFloat(strings.TrimPrefix(bound, "("), 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("ERR min or max is not a float")
+	}
+	return value, exclusive, nil
+}
+
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
@@ -0,0 +1,13 @@
+package fakeredis_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestFakeredis(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Fakeredis Suite")
+}
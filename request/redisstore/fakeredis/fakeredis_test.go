@@ -0,0 +1,193 @@
+package fakeredis_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	. "github.com/thomasmmitchell/recentlyplayedplus/request/redisstore/fakeredis"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+//A connection to the server which sends commands and reads back their replies
+// in the form they were sent, with arrays flattened onto one line.
+type testConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dial(server *Server) *testConn {
+	c, err := net.Dial("tcp", server.Addr())
+	Ω(err).ShouldNot(HaveOccurred())
+	return &testConn{Conn: c, r: bufio.NewReader(c)}
+}
+
+func (c *testConn) send(args ...string) string {
+	fmt.Fprintf(c, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return c.reply()
+}
+
+func (c *testConn) reply() string {
+	line, err := c.r.ReadString('\n')
+	Ω(err).ShouldNot(HaveOccurred())
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '$':
+		if line == "$-1" {
+			return "nil"
+		}
+		body, err := c.r.ReadString('\n')
+		Ω(err).ShouldNot(HaveOccurred())
+		return strings.TrimSuffix(body, "\r\n")
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		Ω(err).ShouldNot(HaveOccurred())
+		if size < 0 {
+			return "nil"
+		}
+		items := make([]string, size)
+		for i := range items {
+			items[i] = c.reply()
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	}
+	return line
+}
+
+var _ = Describe("Fakeredis", func() {
+	var server *Server
+	var conn *testConn
+
+	BeforeEach(func() {
+		var err error
+		server, err = Start()
+		Ω(err).ShouldNot(HaveOccurred())
+		conn = dial(server)
+	})
+
+	AfterEach(func() {
+		conn.Close()
+		server.Close()
+	})
+
+	Context("When using sorted sets", func() {
+		BeforeEach(func() {
+			Ω(conn.send("ZADD", "set", "3", "c", "1", "a", "2", "b")).Should(Equal(":3"))
+		})
+
+		It("should count members within a range of scores", func() {
+			Ω(conn.send("ZCOUNT", "set", "-inf", "+inf")).Should(Equal(":3"))
+			Ω(conn.send("ZCOUNT", "set", "(1", "3")).Should(Equal(":2"))
+			Ω(conn.send("ZCOUNT", "missing", "-inf", "+inf")).Should(Equal(":0"))
+		})
+
+		It("should list members in order of score", func() {
+			Ω(conn.send("ZRANGEBYSCORE", "set", "-inf", "+inf")).Should(Equal("[a b c]"))
+			Ω(conn.send("ZRANGEBYSCORE", "set", "(1", "+inf", "WITHSCORES", "LIMIT", "1", "1")).Should(Equal("[c 3]"))
+		})
+
+		It("should only update existing members with XX", func() {
+			Ω(conn.send("ZADD", "set", "XX", "5", "a", "5", "d")).Should(Equal(":0"))
+			Ω(conn.send("ZRANGEBYSCORE", "set", "-inf", "+inf", "WITHSCORES")).Should(Equal("[b 2 c 3 a 5]"))
+		})
+
+		It("should remove members by name", func() {
+			Ω(conn.send("ZREM", "set", "a", "d")).Should(Equal(":1"))
+			Ω(conn.send("ZRANGEBYSCORE", "set", "-inf", "+inf")).Should(Equal("[b c]"))
+		})
+
+		It("should remove members within a range of scores, and the set once empty", func() {
+			Ω(conn.send("ZREMRANGEBYSCORE", "set", "-inf", "2")).Should(Equal(":2"))
+			Ω(server.Keys()).Should(Equal([]string{"set"}))
+			Ω(conn.send("ZREMRANGEBYSCORE", "set", "-inf", "+inf")).Should(Equal(":1"))
+			Ω(server.Keys()).Should(BeEmpty())
+		})
+
+		It("should only expire keys that exist", func() {
+			Ω(conn.send("PEXPIRE", "set", "1000")).Should(Equal(":1"))
+			Ω(conn.send("PEXPIRE", "missing", "1000")).Should(Equal(":0"))
+		})
+
+		It("should delete keys that exist", func() {
+			Ω(conn.send("DEL", "set", "missing")).Should(Equal(":1"))
+			Ω(server.Keys()).Should(BeEmpty())
+		})
+
+		It("should refuse unknown commands", func() {
+			Ω(conn.send("GET", "set")).Should(HavePrefix("-ERR unknown command"))
+		})
+	})
+
+	Context("When running transactions", func() {
+		It("should run the queued commands together", func() {
+			Ω(conn.send("MULTI")).Should(Equal("+OK"))
+			Ω(conn.send("ZADD", "set", "1", "a")).Should(Equal("+QUEUED"))
+			Ω(conn.send("ZCOUNT", "set", "-inf", "+inf")).Should(Equal("+QUEUED"))
+			Ω(server.Keys()).Should(BeEmpty())
+			Ω(conn.send("EXEC")).Should(Equal("[:1 :1]"))
+		})
+
+		It("should drop the queued commands when discarded", func() {
+			conn.send("MULTI")
+			conn.send("ZADD", "set", "1", "a")
+			Ω(conn.send("DISCARD")).Should(Equal("+OK"))
+			Ω(server.Keys()).Should(BeEmpty())
+		})
+
+		Context("with a key being watched", func() {
+			var other *testConn
+
+			BeforeEach(func() {
+				other = dial(server)
+				Ω(conn.send("WATCH", "set")).Should(Equal("+OK"))
+			})
+
+			AfterEach(func() {
+				other.Close()
+			})
+
+			It("should not go ahead if the key was written in the meantime", func() {
+				other.send("ZADD", "set", "1", "a")
+				conn.send("MULTI")
+				conn.send("ZADD", "set", "2", "b")
+				Ω(conn.send("EXEC")).Should(Equal("nil"))
+				Ω(conn.send("ZRANGEBYSCORE", "set", "-inf", "+inf")).Should(Equal("[a]"))
+			})
+
+			It("should go ahead if the key was left alone", func() {
+				other.send("ZADD", "elsewhere", "1", "a")
+				conn.send("MULTI")
+				conn.send("ZADD", "set", "2", "b")
+				Ω(conn.send("EXEC")).Should(Equal("[:1]"))
+			})
+
+			It("should go ahead once the key is unwatched", func() {
+				Ω(conn.send("UNWATCH")).Should(Equal("+OK"))
+				other.send("ZADD", "set", "1", "a")
+				conn.send("MULTI")
+				conn.send("ZADD", "set", "2", "b")
+				Ω(conn.send("EXEC")).Should(Equal("[:1]"))
+			})
+		})
+	})
+
+	Context("When restarted at the same address", func() {
+		It("should start out empty", func() {
+			conn.send("ZADD", "set", "1", "a")
+			addr := server.Addr()
+			server.Close()
+			var err error
+			server, err = StartAddr(addr)
+			Ω(err).ShouldNot(HaveOccurred())
+			conn = dial(server)
+			Ω(server.Keys()).Should(BeEmpty())
+		})
+	})
+})
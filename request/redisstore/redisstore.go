@@ -0,0 +1,373 @@
+// Package redisstore provides a request.RateStore kept in a server speaking
+// the Redis protocol, so that Limiters in several processes can share one
+// budget for each region of an API key.
+package redisstore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thomasmmitchell/recentlyplayedplus/request"
+)
+
+// Store is a request.RateStore which keeps the requests counted against each
+// limit in a sorted set, scored by the microsecond at which they were made.
+// Each change is made in a transaction, watching the sets it read, so that it
+// is atomic across every process sharing the server. Store is safe for
+// concurrent use.
+type Store struct {
+	addr string
+	//Prepended to the name of every key this store uses
+	prefix string
+	lock   sync.Mutex
+	//nil until the first command, and after a command fails
+	conn *conn
+}
+
+// timeout bounds dialing the server and each command sent to it.
+const timeout = 5 * time.Second
+
+// maxAttempts is the number of times a transaction is tried before giving up,
+// should other clients keep writing the keys it watches.
+const maxAttempts = 10
+
+// New creates a Store which connects to the server at addr, given as
+// host:port, once it is first used. Stores with the same prefix share their
+// counts.
+func New(addr, prefix string) *Store {
+	return &Store{
+		addr:   addr,
+		prefix: prefix,
+	}
+}
+
+// Reserve implements request.RateStore.
+func (s *Store) Reserve(limits []request.Limit, now time.Time) (request.Reservation, error) {
+	token, err := newToken()
+	if err != nil {
+		return request.Reservation{}, err
+	}
+	var res request.Reservation
+	keys := s.keys(limits)
+	err = s.transact(keys, func() ([][]string, error) {
+		res = request.Reservation{Remaining: math.MaxUint32}
+		blocked, neverFree := false, false
+		for i, limit := range limits {
+			used, err := s.count(keys[i], limit.Period, now)
+			if err != nil {
+				return nil, err
+			}
+			if used < int64(limit.Max) {
+				if left := uint32(int64(limit.Max) - used); left < res.Remaining {
+					res.Remaining = left
+				}
+				continue
+			}
+			res.Remaining = 0
+			blocked = true
+			if limit.Period == 0 {
+				neverFree = true
+				continue
+			}
+			//This many requests need to expire to get under the max
+			at, err := s.nthScore(keys[i], limit.Period, now, used-int64(limit.Max))
+			if err != nil {
+				return nil, err
+			}
+			if at = at.Add(window(limit.Period)); at.After(res.RetryAt) {
+				res.RetryAt = at
+			}
+		}
+		if blocked {
+			if neverFree {
+				res.RetryAt = time.Time{}
+			}
+			return nil, nil
+		}
+		res.OK = true
+		res.Token = token
+		var cmds [][]string
+		for i, limit := range limits {
+			cmds = append(cmds, expireCmds(keys[i], limit.Period, now)...)
+			cmds = append(cmds, []string{"ZADD", keys[i], micros(now), token})
+			cmds = append(cmds, ttlCmds(keys[i], limit.Period)...)
+		}
+		return cmds, nil
+	})
+	if err != nil {
+		return request.Reservation{}, err
+	}
+	return res, nil
+}
+
+// Complete implements request.RateStore.
+func (s *Store) Complete(limits []request.Limit, token string, now time.Time) error {
+	var cmds [][]string
+	for i, key := range s.keys(limits) {
+		//XX only moves the request if it is still counted
+		cmds = append(cmds, []string{"ZADD", key, "XX", micros(now), token})
+		cmds = append(cmds, ttlCmds(key, limits[i].Period)...)
+	}
+	return s.transact(nil, func() ([][]string, error) {
+		return cmds, nil
+	})
+}
+
+// Release implements request.RateStore.
+func (s *Store) Release(limits []request.Limit, token string) error {
+	var cmds [][]string
+	for _, key := range s.keys(limits) {
+		cmds = append(cmds, []string{"ZREM", key, token})
+	}
+	return s.transact(nil, func() ([][]string, error) {
+		return cmds, nil
+	})
+}
+
+// Observe implements request.RateStore.
+func (s *Store) Observe(limit request.Limit, count uint32, now time.Time) error {
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+	key := s.keys([]request.Limit{limit})[0]
+	return s.transact([]string{key}, func() ([][]string, error) {
+		used, err := s.count(key, limit.Period, now)
+		if err != nil || used >= int64(count) {
+			return nil, err
+		}
+		cmds := expireCmds(key, limit.Period, now)
+		add := []string{"ZADD", key}
+		for i := used + 1; i <= int64(count); i++ {
+			add = append(add, micros(now), fmt.Sprintf("%s:%d", token, i))
+		}
+		cmds = append(cmds, add)
+		return append(cmds, ttlCmds(key, limit.Period)...), nil
+	})
+}
+
+// Seed implements request.RateStore.
+func (s *Store) Seed(to, from request.Limit, now time.Time) error {
+	keys := s.keys([]request.Limit{to, from})
+	//Only requests which count towards both limits are copied
+	period := to.Period
+	if from.Period != 0 && (period == 0 || from.Period < period) {
+		period = from.Period
+	}
+	return s.transact(keys, func() ([][]string, error) {
+		used, err := s.count(keys[0], to.Period, now)
+		if err != nil {
+			return nil, err
+		}
+		reply, err := s.send("ZRANGEBYSCORE", keys[1], liveFrom(period, now), "+inf", "WITHSCORES")
+		if err != nil {
+			return nil, err
+		}
+		entries, ok := reply.([]interface{})
+		if !ok || len(entries)%2 != 0 {
+			return nil, fmt.Errorf("Unexpected reply to ZRANGEBYSCORE '%v'", reply)
+		}
+		if int64(len(entries)/2) <= used {
+			return nil, nil
+		}
+		add := []string{"ZADD", keys[0]}
+		for i := 0; i < len(entries); i += 2 {
+			member, _ := entries[i].(string)
+			score, _ := entries[i+1].(string)
+			add = append(add, score, member)
+		}
+		cmds := [][]string{{"DEL", keys[0]}, add}
+		return append(cmds, ttlCmds(keys[0], to.Period)...), nil
+	})
+}
+
+// Remaining implements request.RateStore.
+func (s *Store) Remaining(limits []request.Limit, now time.Time) ([]uint32, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ret := make([]uint32, len(limits))
+	for i, key := range s.keys(limits) {
+		used, err := s.count(key, limits[i].Period, now)
+		if err != nil {
+			return nil, err
+		}
+		if used < int64(limits[i].Max) {
+			ret[i] = uint32(int64(limits[i].Max) - used)
+		}
+	}
+	return ret, nil
+}
+
+// Close closes the connection to the server, if there is one. The Store
+// reconnects if it is used again.
+func (s *Store) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func (s *Store) keys(limits []request.Limit) []string {
+	ret := make([]string, 0, len(limits))
+	for _, limit := range limits {
+		ret = append(ret, fmt.Sprintf("%s%s:%d", s.prefix, limit.Key, limit.Period))
+	}
+	return ret
+}
+
+// transact runs check, then the commands it returns in a transaction, which
+// only goes ahead if none of the given keys have been written by anybody else
+// since check started. Otherwise the whole thing is tried again. check reads
+// what it needs with s.send, and returns no commands to have none run.
+func (s *Store) transact(keys []string, check func() ([][]string, error)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if len(keys) > 0 {
+			if _, err := s.send(append([]string{"WATCH"}, keys...)...); err != nil {
+				return err
+			}
+		}
+		cmds, err := check()
+		if err != nil || len(cmds) == 0 {
+			if len(keys) > 0 && s.conn != nil {
+				s.send("UNWATCH")
+			}
+			return err
+		}
+		if _, err = s.send("MULTI"); err != nil {
+			return err
+		}
+		for _, cmd := range cmds {
+			if _, err = s.send(cmd...); err != nil {
+				if s.conn != nil {
+					s.send("DISCARD")
+				}
+				return err
+			}
+		}
+		reply, err := s.send("EXEC")
+		if err != nil {
+			return err
+		}
+		//A transaction which didn't go ahead replies with a null array
+		if reply != nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("Gave up after %d attempts to write keys other clients kept writing", maxAttempts)
+}
+
+// count returns the number of requests counted in the sorted set at key which
+// still count towards a limit with the given period.
+func (s *Store) count(key string, period uint32, now time.Time) (int64, error) {
+	reply, err := s.send("ZCOUNT", key, liveFrom(period, now), "+inf")
+	if err != nil {
+		return 0, err
+	}
+	ret, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("Unexpected reply to ZCOUNT '%v'", reply)
+	}
+	return ret, nil
+}
+
+// nthScore returns the time of the nth oldest request, counting from zero,
+// which still counts towards a limit with the given period.
+func (s *Store) nthScore(key string, period uint32, now time.Time, n int64) (time.Time, error) {
+	reply, err := s.send("ZRANGEBYSCORE", key, liveFrom(period, now), "+inf",
+		"WITHSCORES", "LIMIT", strconv.FormatInt(n, 10), "1")
+	if err != nil {
+		return time.Time{}, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return time.Time{}, fmt.Errorf("Unexpected reply to ZRANGEBYSCORE '%v'", reply)
+	}
+	score, _ := values[1].(string)
+	at, err := strconv.ParseFloat(score, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Unexpected score '%v'", values[1])
+	}
+	return time.Unix(0, int64(at)*int64(time.Microsecond)), nil
+}
+
+// send sends a command to the server, connecting first if need be. Should the
+// connection fail, it is dropped so that the next command reconnects. Must be
+// called with the lock held.
+func (s *Store) send(args ...string) (interface{}, error) {
+	if s.conn == nil {
+		c, err := dial(s.addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		s.conn = c
+	}
+	s.conn.SetDeadline(time.Now().Add(timeout))
+	reply, err := s.conn.do(args...)
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return nil, err
+	}
+	if rerr, ok := reply.(redisError); ok {
+		return nil, rerr
+	}
+	return reply, nil
+}
+
+// liveFrom is the least score, exclusive, of the requests which still count
+// towards a limit with the given period. Requests counted against a period of
+// zero never stop counting.
+func liveFrom(period uint32, now time.Time) string {
+	if period == 0 {
+		return "-inf"
+	}
+	return "(" + strconv.FormatInt(now.Add(-window(period)).UnixNano()/int64(time.Microsecond), 10)
+}
+
+// expireCmds drop the requests in the sorted set at key which no longer count
+// towards a limit with the given period.
+func expireCmds(key string, period uint32, now time.Time) [][]string {
+	if period == 0 {
+		return nil
+	}
+	return [][]string{{"ZREMRANGEBYSCORE", key, "-inf", strings.TrimPrefix(liveFrom(period, now), "(")}}
+}
+
+// ttlCmds have the sorted set at key deleted once nothing in it can count
+// towards a limit with the given period any longer.
+func ttlCmds(key string, period uint32) [][]string {
+	if period == 0 {
+		return nil
+	}
+	return [][]string{{"PEXPIRE", key, strconv.FormatInt(int64(window(period)/time.Millisecond), 10)}}
+}
+
+// newToken returns a token which is unique across every process sharing the
+// server.
+func newToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func micros(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Microsecond), 10)
+}
+
+func window(period uint32) time.Duration {
+	return time.Duration(period) * time.Second
+}
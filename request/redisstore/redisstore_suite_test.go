@@ -0,0 +1,13 @@
+package redisstore_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestRedisstore(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Redisstore Suite")
+}
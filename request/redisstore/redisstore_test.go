@@ -0,0 +1,233 @@
+package redisstore_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/thomasmmitchell/recentlyplayedplus/request"
+	"github.com/thomasmmitchell/recentlyplayedplus/request/fakeclock"
+	. "github.com/thomasmmitchell/recentlyplayedplus/request/redisstore"
+	"github.com/thomasmmitchell/recentlyplayedplus/request/redisstore/fakeredis"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store", func() {
+	var server *fakeredis.Server
+	var store *Store
+	var now time.Time
+	limits := []request.Limit{
+		{Key: "na", Period: 10, Max: 3},
+		{Key: "na/game", Period: 1, Max: 2},
+	}
+
+	reserve := func(s *Store) request.Reservation {
+		res, err := s.Reserve(limits, now)
+		Ω(err).ShouldNot(HaveOccurred())
+		return res
+	}
+
+	BeforeEach(func() {
+		var err error
+		server, err = fakeredis.Start()
+		Ω(err).ShouldNot(HaveOccurred())
+		store = New(server.Addr(), "rpp:")
+		now = time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC)
+	})
+
+	AfterEach(func() {
+		store.Close()
+		server.Close()
+	})
+
+	Context("When reserving", func() {
+		It("should count against every limit until one runs out", func() {
+			res := reserve(store)
+			Ω(res.OK).Should(BeTrue())
+			Ω(res.Token).ShouldNot(BeEmpty())
+			Ω(res.Remaining).Should(BeEquivalentTo(2))
+			Ω(reserve(store).OK).Should(BeTrue())
+			res = reserve(store)
+			Ω(res.OK).Should(BeFalse())
+			Ω(res.Remaining).Should(BeEquivalentTo(0))
+			Ω(res.RetryAt).Should(BeTemporally("==", now.Add(time.Second)))
+			Ω(server.Keys()).Should(ConsistOf("rpp:na:10", "rpp:na/game:1"))
+		})
+
+		It("should not count against any limit when refused", func() {
+			reserve(store)
+			reserve(store)
+			reserve(store)
+			now = now.Add(time.Second)
+			Ω(reserve(store).OK).Should(BeTrue())
+			res := reserve(store)
+			Ω(res.OK).Should(BeFalse())
+			Ω(res.RetryAt).Should(BeTemporally("==", now.Add(9*time.Second)))
+		})
+
+		It("should never allow more once a limit with no period runs out", func() {
+			once := []request.Limit{{Key: "na", Period: 0, Max: 1}}
+			res, err := store.Reserve(once, now)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(res.OK).Should(BeTrue())
+			res, err = store.Reserve(once, now.Add(time.Hour))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(res.OK).Should(BeFalse())
+			Ω(res.RetryAt.IsZero()).Should(BeTrue())
+		})
+
+		It("should allow anything when there are no limits", func() {
+			res, err := store.Reserve(nil, now)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(res.OK).Should(BeTrue())
+			Ω(res.Remaining).Should(BeEquivalentTo(4294967295))
+		})
+	})
+
+	Context("When completing", func() {
+		It("should return allowance one period after completion", func() {
+			once := []request.Limit{{Key: "na/game", Period: 1, Max: 1}}
+			res, err := store.Reserve(once, now)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(store.Complete(once, res.Token, now.Add(500*time.Millisecond))).Should(Succeed())
+			res, err = store.Reserve(once, now.Add(time.Second))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(res.OK).Should(BeFalse())
+			Ω(res.RetryAt).Should(BeTemporally("==", now.Add(1500*time.Millisecond)))
+		})
+	})
+
+	Context("When releasing", func() {
+		It("should return allowance straight away", func() {
+			token := reserve(store).Token
+			reserve(store)
+			Ω(store.Release(limits, token)).Should(Succeed())
+			Ω(reserve(store).OK).Should(BeTrue())
+		})
+	})
+
+	Context("When seeding", func() {
+		It("should copy the requests within the new limit's period", func() {
+			long := request.Limit{Key: "na", Period: 600, Max: 10}
+			short := request.Limit{Key: "na", Period: 10, Max: 5}
+			for _, at := range []time.Duration{0, 595 * time.Second, 598 * time.Second} {
+				_, err := store.Reserve([]request.Limit{long}, now.Add(at))
+				Ω(err).ShouldNot(HaveOccurred())
+			}
+			now = now.Add(599 * time.Second)
+			Ω(store.Seed(short, long, now)).Should(Succeed())
+			remaining, err := store.Remaining([]request.Limit{short, long}, now)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(remaining).Should(Equal([]uint32{3, 7}))
+		})
+	})
+
+	Context("When observing", func() {
+		It("should take allowance counted elsewhere", func() {
+			Ω(store.Observe(limits[0], 2, now)).Should(Succeed())
+			Ω(store.Observe(limits[0], 1, now)).Should(Succeed())
+			Ω(reserve(store).Remaining).Should(BeEquivalentTo(1))
+			Ω(reserve(store).OK).Should(BeFalse())
+		})
+	})
+
+	Context("When asked what remains", func() {
+		It("should report each limit without counting against it", func() {
+			reserve(store)
+			remaining, err := store.Remaining(limits, now)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(remaining).Should(Equal([]uint32{2, 1}))
+			remaining, err = store.Remaining(limits, now.Add(time.Second))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(remaining).Should(Equal([]uint32{2, 2}))
+		})
+	})
+
+	Context("When shared between processes", func() {
+		var other *Store
+
+		BeforeEach(func() {
+			other = New(server.Addr(), "rpp:")
+		})
+
+		AfterEach(func() {
+			other.Close()
+		})
+
+		It("should share one budget", func() {
+			Ω(reserve(store).OK).Should(BeTrue())
+			Ω(reserve(other).OK).Should(BeTrue())
+			Ω(reserve(store).OK).Should(BeFalse())
+			Ω(reserve(other).OK).Should(BeFalse())
+		})
+
+		It("should never count more than the max when reserving concurrently", func() {
+			once := []request.Limit{{Key: "na", Period: 10, Max: 5}}
+			results := make(chan request.Reservation, 20)
+			for i := 0; i < 20; i++ {
+				go func(s *Store) {
+					defer GinkgoRecover()
+					res, err := s.Reserve(once, now)
+					Ω(err).ShouldNot(HaveOccurred())
+					results <- res
+				}([]*Store{store, other}[i%2])
+			}
+			reserved := 0
+			for i := 0; i < 20; i++ {
+				if res := <-results; res.OK {
+					reserved++
+				}
+			}
+			Ω(reserved).Should(Equal(5))
+		})
+
+		It("should not share with a different prefix", func() {
+			other = New(server.Addr(), "elsewhere:")
+			reserve(store)
+			reserve(store)
+			Ω(reserve(other).OK).Should(BeTrue())
+		})
+
+		It("should share between Limiters", func() {
+			clock := fakeclock.New(now)
+			limiters := []*request.Limiter{
+				request.NewLimiterWithStore(store, clock),
+				request.NewLimiterWithStore(other, clock),
+			}
+			for _, lim := range limiters {
+				Ω(lim.AddRegion("na")).Should(Succeed())
+				Ω(lim.AddRate(3, 10, "na")).Should(Succeed())
+			}
+			done := make(chan struct{}, 4)
+			for i := 0; i < 4; i++ {
+				_, err := limiters[i%2].Enqueue(doerFunc(func() { done <- struct{}{} }), "na")
+				Ω(err).ShouldNot(HaveOccurred())
+			}
+			Eventually(done).Should(HaveLen(3))
+			Consistently(done, "200ms").Should(HaveLen(3))
+			for _, lim := range limiters {
+				lim.Stop(context.Background(), request.RejectQueued)
+			}
+		})
+	})
+
+	Context("When the server goes away", func() {
+		It("should err, then reconnect once it is back", func() {
+			Ω(reserve(store).OK).Should(BeTrue())
+			addr := server.Addr()
+			server.Close()
+			_, err := store.Reserve(limits, now)
+			Ω(err).Should(HaveOccurred())
+			server, err = fakeredis.StartAddr(addr)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(reserve(store).OK).Should(BeTrue())
+		})
+	})
+})
+
+type doerFunc func()
+
+func (f doerFunc) Do() {
+	f()
+}
@@ -0,0 +1,88 @@
+package redisstore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// conn is a connection to a server speaking the Redis protocol (RESP).
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// redisError is an error reply from the server. Unlike other errors, it
+// leaves the connection usable.
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+func dial(addr string, timeout time.Duration) (*conn, error) {
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// do sends a command and returns the server's reply, which is one of string,
+// int64, []interface{}, nil or redisError.
+func (c *conn) do(args ...string) (interface{}, error) {
+	w := bufio.NewWriter(c)
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return c.reply()
+}
+
+func (c *conn) reply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("Malformed reply '%s'", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return redisError(body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(body)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(body)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		ret := make([]interface{}, size)
+		for i := range ret {
+			if ret[i], err = c.reply(); err != nil {
+				return nil, err
+			}
+		}
+		return ret, nil
+	}
+	return nil, fmt.Errorf("Unknown reply type '%c'", kind)
+}
@@ -1,11 +1,16 @@
 package request
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
+	"errors"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/thomasmmitchell/recentlyplayedplus/config"
 	"github.com/thomasmmitchell/recentlyplayedplus/types"
@@ -21,11 +26,110 @@ type LimitedDoer interface {
 	Do()
 }
 
-//A limiter class to be used with the Riot API requests.
-var lim *Limiter
+// The methods which requests to the Riot API are bucketed into, each of which
+// the API holds to its own rate limits on top of the limits of the API key.
+// These are the names under which method rates are configured.
+const (
+	// MethodSummoner covers summoner lookups.
+	MethodSummoner = "summoner"
+	// MethodGame covers recent game history lookups.
+	MethodGame = "game"
+)
+
+//The Client behind the package functions. nil until Init is called.
+var defaultClient *Client
+
+//The RateStore which the default Client counts requests in, if not its own
+var defaultStore RateStore
+
+//Guards defaultClient and defaultStore
+var initLock sync.Mutex
+
+// Init creates the Client behind the functions of this package from cfg, which
+// is usually config.Current() once config.LoadConfig has been called. Those
+// functions fail until Init has been called. Errs if cfg is nil, as
+// config.Current() is until a configuration has been loaded, if cfg fails
+// validation, or if Init has already been called.
+func Init(cfg *config.Config) error {
+	initLock.Lock()
+	defer initLock.Unlock()
+	if defaultClient != nil {
+		return errors.New("Requests have already been initialised")
+	}
+	if cfg == nil {
+		return errors.New("Cannot initialise requests before a configuration is loaded")
+	}
+	lim := NewLimiter()
+	if defaultStore != nil {
+		lim = NewLimiterWithStore(defaultStore, realClock{})
+	}
+	client, err := NewClientWithLimiter(cfg, lim)
+	if err != nil {
+		lim.Stop(context.Background(), RejectQueued)
+		return err
+	}
+	defaultClient = client
+	return nil
+}
+
+// UseRateStore has requests made by the functions of this package count
+// against the rates of the API key in the given RateStore, such as one shared
+// with other processes using the same key. Errs if Init has already been
+// called.
+func UseRateStore(store RateStore) error {
+	initLock.Lock()
+	defer initLock.Unlock()
+	if defaultClient != nil {
+		return errors.New("Cannot change the rate store once requests are initialised")
+	}
+	defaultStore = store
+	return nil
+}
 
-func init() {
-	lim = NewLimiter()
+// initialised returns the Client created by Init, or errs if Init hasn't been
+// called yet.
+func initialised() (*Client, error) {
+	initLock.Lock()
+	defer initLock.Unlock()
+	if defaultClient == nil {
+		return nil, errors.New("Requests have not been initialised; call Init first")
+	}
+	return defaultClient, nil
+}
+
+// WatchConfig reloads the configuration file at path whenever it changes, and
+// applies it to the Client created by Init as Client.WatchConfig does. Each
+// configuration applied also becomes config.Current(). Errs if Init hasn't
+// been called.
+func WatchConfig(path string, interval time.Duration, onChange func(error)) (*config.Watcher, error) {
+	client, err := initialised()
+	if err != nil {
+		return nil, err
+	}
+	return config.Watch(path, interval, func(cfg *config.Config, err error) {
+		if err == nil {
+			if err = client.Reconfigure(cfg); err == nil {
+				config.Use(cfg)
+			}
+		}
+		if onChange != nil {
+			onChange(err)
+		}
+	}), nil
+}
+
+// MetricsHandler serves the metrics of the Limiter of the Client created by
+// Init, in the Prometheus text format. See Limiter.MetricsHandler. Serves 503
+// Service Unavailable until Init has been called.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, err := initialised()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		client.Limiter().MetricsHandler().ServeHTTP(w, r)
+	})
 }
 
 // Request contains information about an HTTP request to make to the Riot API.
@@ -34,83 +138,230 @@ func init() {
 // Note that all Riot API endpoints respond only to GET requests, and therefore
 // tracking of the request method is not necessary.
 type request struct {
-	url  string
-	body chan []byte
-	err  chan error
-}
-
-// GetSummoners retrieves information about the specified summoners, given
-// their summoner name and region. An API Key must be configured.
-func GetSummoners(region string, names ...string) (types.Summoner, error) {
-	endpoint := fmt.Sprintf("/api/lol/%s/v1.4/summoner/by-name/%s", region, strings.Join(names, ", "))
-	req := getBaseRequest(region, endpoint)
-	//Throwing away queue position for now. Can be used for logging later.
-	_, err := lim.Enqueue(req, region)
+	ctx context.Context
+	//The Client sending the request, and how it sends it
+	client     *Client
+	httpClient *http.Client
+	userAgent  string
+	region     string
+	//The rate limited API method (e.g. MethodSummoner) the request is for
+	method   string
+	priority Priority
+	//The path requested, and the URL it is requested at
+	endpoint string
+	url      string
+	//Sent in the apiKeyHeader, and kept out of every error
+	apiKey string
+	body   chan []byte
+	err    chan error
+	//Number of times this request has been sent and turned away with a 429
+	rateLimited int
+}
+
+// maxRateLimitRetries is the number of times a request turned away with a 429
+// is sent again before giving up with a RateLimitError.
+const maxRateLimitRetries = 3
+
+// GetSummoners looks up the summoners with the given names in region with the
+// Client created by Init. See Client.GetSummoners.
+func GetSummoners(region string, names ...string) (map[string]types.Summoner, []string, error) {
+	return GetSummonersContext(context.Background(), region, names...)
+}
+
+// GetSummonersContext is GetSummoners, but gives up once ctx is done. See
+// Client.GetSummonersContext.
+func GetSummonersContext(ctx context.Context, region string, names ...string) (map[string]types.Summoner, []string, error) {
+	client, err := initialised()
 	if err != nil {
-		return types.Summoner{}, err
+		return nil, nil, err
 	}
-	var response []byte
-	select {
-	case response = <-req.body:
-	case err = <-req.err:
-		return types.Summoner{}, err
-	}
-	ret := types.Summoner{}
-	json.Unmarshal(response, &ret)
-	return ret, nil
+	return client.GetSummonersContext(ctx, region, names...)
 }
 
 // GetRecentGames retrieves a summoner's recent match history, given their region
-// and region-unique SummonerID. An API Key must be configured.
+// and region-unique SummonerID, with the Client created by Init. apiKey is
+// ignored in favour of the API key the Client was configured with.
 func GetRecentGames(region string, summonerid int64, apiKey string) (types.Matchlist, error) {
-	endpoint := fmt.Sprintf("/api/lol/%s/v1.3/game/by-summoner/%d", region, summonerid)
-	req := getBaseRequest(region, endpoint)
-	//Throwing away queue position for now. Can be used for logging later.
-	_, err := lim.Enqueue(req, region)
+	return GetRecentGamesContext(context.Background(), region, summonerid, apiKey)
+}
+
+// GetRecentGamesContext is GetRecentGames, but gives up once ctx is done. See
+// Client.GetRecentGamesContext.
+func GetRecentGamesContext(ctx context.Context, region string, summonerid int64, apiKey string) (types.Matchlist, error) {
+	client, err := initialised()
 	if err != nil {
 		return types.Matchlist{}, err
 	}
-	var response []byte
-	select {
-	case response = <-req.body:
-	case err = <-req.err:
-		return types.Matchlist{}, err
-	}
-	ret := types.Matchlist{}
-	json.Unmarshal(response, &ret)
-	return ret, nil
+	return client.GetRecentGamesContext(ctx, region, summonerid)
 }
 
-func (r request) Do() {
-	resp, err := http.Get(r.url)
+// Do sends the request, handing its response body or error to whoever is
+// waiting on it.
+func (r *request) Do() {
+	r.DoResult()
+}
+
+// DoResult is Do, reporting to the Limiter whether the request reached the API
+// and whether the API turned it away for exceeding the rate limits.
+func (r *request) DoResult() Result {
+	httpReq, err := http.NewRequest("GET", r.url, nil)
 	if err != nil {
-		r.err <- err
-		return
+		r.err <- scrub(err, r.apiKey)
+		return Result{Outcome: OutcomeNotSent}
 	}
-	if resp.StatusCode/100 != 2 {
-		r.err <- fmt.Errorf("Request returned '%s'", resp.Status)
+	httpReq.Header.Set(apiKeyHeader, r.apiKey)
+	if r.userAgent != "" {
+		httpReq.Header.Set("User-Agent", r.userAgent)
+	}
+	resp, err := r.httpClient.Do(httpReq.WithContext(r.ctx))
+	if err != nil {
+		r.err <- scrub(err, r.apiKey)
+		if isDialError(err) {
+			return Result{Outcome: OutcomeNotSent}
+		}
+		return Result{Outcome: OutcomeFailed}
 	}
 	defer resp.Body.Close()
+	r.client.reconcileRates(r.region, r.method, resp.Header)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return r.retryRateLimited(resp)
+	}
+	if resp.StatusCode/100 != 2 {
+		r.err <- r.apiError(resp)
+		return Result{Outcome: OutcomeFailed}
+	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		r.err <- err
-		return
+		r.err <- scrub(err, r.apiKey)
+		return Result{Outcome: OutcomeFailed}
 	}
 	r.body <- body
+	return Result{Outcome: OutcomeSucceeded}
+}
+
+// apiError describes a response with a status other than 2xx.
+func (r *request) apiError(resp *http.Response) *APIError {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	retryAfter, _ := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	return &APIError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Region:     r.region,
+		Endpoint:   r.endpoint,
+		RetryAfter: retryAfter,
+		Body:       scrubString(string(body), r.apiKey),
+	}
+}
+
+// isDialError is true if err means that a connection to the API couldn't be
+// made, so the request never reached it.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// Reject tells whoever is waiting on this request that it will never be sent.
+func (r *request) Reject(err error) {
+	r.err <- err
 }
 
-func getBaseURL(region string) string {
-	return fmt.Sprintf("https://%[1]s.api.pvp.net/api/lol/%[1]s", region)
+// retryRateLimited handles a 429 response to this request. The Limiter is told
+// to freeze the region until the time given by the Retry-After header, or for
+// the shortest period of its rates if there is none, and to put the request
+// back at the head of the region's queue, unless it has already been retried
+// too often or its caller has given up on it.
+func (r *request) retryRateLimited(resp *http.Response) Result {
+	r.rateLimited++
+	wait, _ := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	result := Result{Outcome: OutcomeThrottled, RetryAfter: wait}
+	if r.rateLimited > maxRateLimitRetries {
+		r.err <- &RateLimitError{
+			Region:     r.region,
+			Attempts:   r.rateLimited,
+			RetryAfter: wait,
+			Last:       r.apiError(resp),
+		}
+		return result
+	}
+	if r.ctx.Err() != nil {
+		r.err <- r.ctx.Err()
+		return result
+	}
+	result.Requeue = true
+	return result
 }
 
-func glueURL(base, endpoint, devKey string) string {
-	return fmt.Sprintf("%s%s?api_key=%s", base, endpoint, devKey)
+// apiKeyHeader is the request header the API key is sent in. The key is kept
+// out of URLs, which end up in error messages and the logs of proxies.
+const apiKeyHeader = "X-Riot-Token"
+
+// Response headers in which the API reports the rate limits of the API key and
+// of the method, and how many requests it has counted against each of them.
+// All hold a comma separated list of "value:period" pairs, e.g. "10:10,500:600".
+const (
+	rateLimitHeader       = "X-App-Rate-Limit"
+	rateCountHeader       = "X-Rate-Limit-Count"
+	rateCountHeaderAlias  = "X-App-Rate-Limit-Count"
+	methodRateLimitHeader = "X-Method-Rate-Limit"
+	methodRateCountHeader = "X-Method-Rate-Limit-Count"
+)
+
+// reconcileRates updates the limiter's idea of the rates for a region and
+// method from the rate limit headers of a response to a request made for them.
+func (c *Client) reconcileRates(region, method string, header http.Header) {
+	counts := header.Get(rateCountHeader)
+	if counts == "" {
+		counts = header.Get(rateCountHeaderAlias)
+	}
+	limits := header.Get(rateLimitHeader)
+	if counts != "" || limits != "" {
+		c.lim.Reconcile(region, parseRateHeader(limits), parseRateHeader(counts))
+	}
+	counts = header.Get(methodRateCountHeader)
+	limits = header.Get(methodRateLimitHeader)
+	if counts != "" || limits != "" {
+		c.lim.ReconcileMethod(region, method, parseRateHeader(limits), parseRateHeader(counts))
+	}
 }
 
-func getBaseRequest(region, endpoint string) request {
-	return request{
-		url:  glueURL(getBaseURL(region), endpoint, config.ApiKey()),
-		body: make(chan []byte, 1),
-		err:  make(chan error, 1),
+// parseRateHeader reads a rate limit header into a map from period to value.
+// Pairs which can't be read are skipped.
+func parseRateHeader(header string) map[uint32]uint32 {
+	ret := make(map[uint32]uint32)
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Split(strings.TrimSpace(pair), ":")
+		if len(parts) != 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		period, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			continue
+		}
+		ret[uint32(period)] = uint32(value)
+	}
+	return ret
+}
+
+// parseRetryAfter reads the value of a Retry-After header, which may either be
+// a number of seconds or an HTTP date. Returns false if the header is empty or
+// can't be read.
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(header); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	at, err := http.ParseTime(header)
+	if err != nil {
+		return 0, false
+	}
+	if at.Before(now) {
+		return 0, true
 	}
+	return at.Sub(now), true
 }
@@ -1,6 +1,12 @@
 package request_test
 
 import (
+	"context"
+
+	"github.com/thomasmmitchell/recentlyplayedplus/config"
+	. "github.com/thomasmmitchell/recentlyplayedplus/request"
+	"github.com/thomasmmitchell/recentlyplayedplus/request/fakeriot"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
@@ -11,3 +17,41 @@ func TestRequest(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Request Suite")
 }
+
+// fakeAPI is a fake of the Riot API, and a Client configured to send requests
+// to it.
+type fakeAPI struct {
+	server *fakeriot.Server
+	cfg    *config.Config
+	client *Client
+}
+
+// withFakeAPI starts a fake of the Riot API before each spec in the container
+// it is called from, and closes it after. cfg can be changed in a BeforeEach
+// before the client is made from it in a JustBeforeEach.
+func withFakeAPI() *fakeAPI {
+	api := &fakeAPI{}
+	BeforeEach(func() {
+		api.server = fakeriot.New()
+		api.cfg = &config.Config{
+			APIKey:  "key",
+			Regions: []string{"na"},
+			HTTP:    config.HTTP{BaseURL: api.server.BaseURL()},
+		}
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		api.client, err = NewClient(api.cfg)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		if api.client != nil {
+			api.client.Stop(context.Background())
+			api.client = nil
+		}
+		api.server.Close()
+	})
+	return api
+}
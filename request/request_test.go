@@ -0,0 +1,306 @@
+package request_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thomasmmitchell/recentlyplayedplus/config"
+	. "github.com/thomasmmitchell/recentlyplayedplus/request"
+	"github.com/thomasmmitchell/recentlyplayedplus/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+//Stands in for the Riot API by answering every request with an empty JSON
+// object after the given latency, counting the requests which reach it.
+type countingTransport struct {
+	lock     sync.Mutex
+	hits     int
+	inFlight int
+	//The most requests which were waiting on the transport at once
+	peak    int
+	latency time.Duration
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.lock.Lock()
+	t.hits++
+	t.inFlight++
+	if t.inFlight > t.peak {
+		t.peak = t.inFlight
+	}
+	t.lock.Unlock()
+	time.Sleep(t.latency)
+	t.lock.Lock()
+	t.inFlight--
+	t.lock.Unlock()
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader("{}")),
+		Request:    req,
+	}, nil
+}
+
+func (t *countingTransport) count() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.hits
+}
+
+func (t *countingTransport) peakInFlight() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.peak
+}
+
+var _ = Describe("Request", func() {
+	Context("When initialising", func() {
+		AfterEach(func() {
+			ResetDefaultClient()
+		})
+
+		It("should only initialise once, from a valid configuration", func() {
+			_, _, err := GetSummoners("na", "someone")
+			Ω(err).Should(MatchError(ContainSubstring("Init")), "Requests should fail before Init")
+			Ω(Init(nil)).Should(MatchError("Cannot initialise requests before a configuration is loaded"), "Should not initialise without a configuration")
+			invalid := &config.Config{Regions: []string{"atlantis"}}
+			Ω(Init(invalid)).Should(MatchError(ContainSubstring("atlantis")), "Should not initialise with an unknown region")
+			valid := &config.Config{
+				Regions: []string{"na"},
+				Rates:   []types.Rate{{Period: 10, Max: 10}},
+			}
+			Ω(Init(valid)).Should(Succeed(), "Should initialise with a valid configuration")
+			Ω(Init(valid)).ShouldNot(Succeed(), "Should not initialise twice")
+			Ω(UseRateStore(NewMemoryStore())).ShouldNot(Succeed(), "Should not change the store once initialised")
+		})
+	})
+
+	Context("When reading a rate limit header", func() {
+		headers := []struct {
+			header string
+			parsed map[uint32]uint32
+		}{
+			{"", map[uint32]uint32{}},
+			{"10:10", map[uint32]uint32{10: 10}},
+			{"10:10,500:600", map[uint32]uint32{10: 10, 600: 500}},
+			{" 10:10 , 500:600 ", map[uint32]uint32{10: 10, 600: 500}},
+			{"10:10,bad,5:x,x:5,:1,1:,1:2:3,7:1", map[uint32]uint32{10: 10, 1: 7}},
+			{"-1:10,10:-1,4294967296:10", map[uint32]uint32{}},
+		}
+		for _, h := range headers {
+			header, parsed := h.header, h.parsed
+			It("should read '"+header+"'", func() {
+				Ω(ParseRateHeader(header)).Should(Equal(parsed))
+			})
+		}
+	})
+
+	Context("When reconciling rates with the headers of a response", func() {
+		var client *Client
+
+		//The allowance left for a method of the region, as reported by enqueuing
+		// a task for it
+		allowanceFor := func(method string) uint32 {
+			ret, err := client.Limiter().EnqueueMethod(newTestDoer(0), "na", method)
+			Ω(err).ShouldNot(HaveOccurred())
+			return ret
+		}
+		allowance := func() uint32 {
+			return allowanceFor(MethodGame)
+		}
+
+		BeforeEach(func() {
+			var err error
+			client, err = NewClient(&config.Config{
+				Regions: []string{"na"},
+				Rates:   []types.Rate{{Period: 10, Max: 100}},
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			client.Stop(context.Background())
+		})
+
+		headers := []struct {
+			description string
+			header      http.Header
+			allowance   uint32
+		}{
+			{
+				"should lower the region's rates to the limits of the API key",
+				http.Header{"X-App-Rate-Limit": {"5:10"}}, 5,
+			},
+			{
+				"should add the region's rates which aren't configured",
+				http.Header{"X-App-Rate-Limit": {"5:1"}}, 5,
+			},
+			{
+				"should use up the allowance the API has counted",
+				http.Header{"X-Rate-Limit-Count": {"40:10"}}, 60,
+			},
+			{
+				"should read the count from the alias of its header",
+				http.Header{"X-App-Rate-Limit-Count": {"40:10"}}, 60,
+			},
+			{
+				"should give the method's limits and counts to the method",
+				http.Header{"X-Method-Rate-Limit": {"3:10"}, "X-Method-Rate-Limit-Count": {"1:10"}}, 2,
+			},
+			{
+				"should ignore headers it can't read",
+				http.Header{"X-App-Rate-Limit": {"5"}, "X-Rate-Limit-Count": {"ten:10"}}, 100,
+			},
+		}
+		for _, h := range headers {
+			header, expected := h.header, h.allowance
+			It(h.description, func() {
+				client.ReconcileRates("na", MethodGame, header)
+				Ω(allowance()).Should(Equal(expected))
+			})
+		}
+
+		It("should leave the rates of other methods alone", func() {
+			client.ReconcileRates("na", MethodGame, http.Header{"X-Method-Rate-Limit": {"3:10"}})
+			Ω(allowanceFor(MethodSummoner)).Should(Equal(uint32(100)))
+		})
+	})
+
+	Context("When the API reports its rate limits", func() {
+		api := withFakeAPI()
+
+		BeforeEach(func() {
+			//Stale, as the API key has since been given a lower limit
+			api.cfg.Rates = []types.Rate{{Period: 10, Max: 100}}
+			api.server.SetRateLimits(types.Rate{Period: 10, Max: 3})
+			api.server.SetMethodRateLimits("game", types.Rate{Period: 10, Max: 2})
+		})
+
+		It("should tighten the configured rates from the response", func() {
+			_, err := api.client.GetRecentGames("na", 42)
+			Ω(err).ShouldNot(HaveOccurred())
+			metrics, err := api.client.Limiter().Metrics()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(metrics[0].Allowance).Should(Equal(map[uint32]uint32{10: 2}))
+			Ω(metrics[0].MethodAllowance).Should(Equal(map[string]map[uint32]uint32{MethodGame: {10: 1}}))
+		})
+	})
+
+	Context("When the context is already done", func() {
+		var ctx context.Context
+		var client *Client
+
+		BeforeEach(func() {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithCancel(context.Background())
+			cancel()
+			var err error
+			client, err = NewClient(&config.Config{Regions: []string{"na"}})
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			client.Stop(context.Background())
+		})
+
+		It("should give up on summoner lookups with the context's error", func() {
+			_, _, err := client.GetSummonersContext(ctx, "na", "someone")
+			Ω(err).Should(Equal(context.Canceled))
+		})
+
+		It("should give up on recent game lookups with the context's error", func() {
+			_, err := client.GetRecentGamesContext(ctx, "na", 1)
+			Ω(err).Should(Equal(context.Canceled))
+		})
+	})
+
+	Context("When the context is cancelled while the request is queued", func() {
+		var client *Client
+		var transport *countingTransport
+
+		queued := func() int {
+			depth, err := client.Limiter().QueueDepth("na")
+			Ω(err).ShouldNot(HaveOccurred())
+			return depth[PriorityNormal]
+		}
+
+		BeforeEach(func() {
+			var err error
+			client, err = NewClient(&config.Config{
+				Regions: []string{"na"},
+				Rates:   []types.Rate{{Period: 1, Max: 1}},
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+			transport = &countingTransport{}
+			client.SetHTTPClient(&http.Client{Transport: transport})
+			//Use up the allowance so that the next request has to queue
+			doer := newTestDoer(0)
+			_, err = client.Limiter().Enqueue(doer, "na")
+			Ω(err).ShouldNot(HaveOccurred())
+			_, retrieved := doer.wait(time.Second)
+			Ω(retrieved).Should(BeTrue(), "The task using up the allowance should have been performed")
+		})
+
+		AfterEach(func() {
+			client.Stop(context.Background())
+		})
+
+		It("should withdraw the request without ever sending it", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			errs := make(chan error, 1)
+			go func() {
+				_, _, err := client.GetSummonersContext(ctx, "na", "someone")
+				errs <- err
+			}()
+			Eventually(queued).Should(Equal(1), "The request should have queued")
+			cancel()
+			Eventually(errs).Should(Receive(Equal(context.Canceled)))
+			Ω(queued()).Should(BeZero(), "The request should have left the queue")
+			Consistently(transport.count, 2*time.Second).Should(BeZero(),
+				"The request should not be sent once the allowance is replenished")
+		})
+	})
+
+	Context("When initialised from a configuration capping the requests in flight", func() {
+		var transport *countingTransport
+		var previousClient *http.Client
+
+		BeforeEach(func() {
+			confPath := os.Getenv("GOPATH") + "/src/github.com/thomasmmitchell/recentlyplayedplus/raw/testconfs/output/onereginflight.yml"
+			Ω(config.LoadConfig(confPath)).Should(Succeed())
+			transport = &countingTransport{latency: 100 * time.Millisecond}
+			previousClient = http.DefaultClient
+			http.DefaultClient = &http.Client{Transport: transport}
+			Ω(Init(config.Current())).Should(Succeed())
+		})
+
+		AfterEach(func() {
+			http.DefaultClient = previousClient
+			ResetDefaultClient()
+		})
+
+		It("should hold the region to its cap", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 6; i++ {
+				wg.Add(1)
+				go func(id int64) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					_, err := GetRecentGames("na", id, "")
+					Ω(err).ShouldNot(HaveOccurred())
+				}(int64(i))
+			}
+			wg.Wait()
+			Ω(transport.count()).Should(Equal(6))
+			Ω(transport.peakInFlight()).Should(Equal(4))
+		})
+	})
+})
@@ -0,0 +1,67 @@
+package request
+
+import "time"
+
+// Outcome classifies how a task performed by a Limiter went, as far as the
+// rates it is held to are concerned.
+type Outcome int
+
+const (
+	// OutcomeSucceeded is for a task whose request the server handled.
+	OutcomeSucceeded Outcome = iota
+	// OutcomeFailed is for a task whose request reached the server but
+	// failed. It counts against the rates all the same.
+	OutcomeFailed
+	// OutcomeNotSent is for a task whose request never reached the server,
+	// such as when the connection couldn't be made. The allowance it was
+	// given is refunded.
+	OutcomeNotSent
+	// OutcomeThrottled is for a task whose request the server turned away for
+	// exceeding its rate limits. The task's region is frozen for as long as
+	// the server asked, or for the shortest period of the task's rates if it
+	// didn't say.
+	OutcomeThrottled
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeSucceeded:
+		return "succeeded"
+	case OutcomeFailed:
+		return "failed"
+	case OutcomeNotSent:
+		return "not sent"
+	case OutcomeThrottled:
+		return "throttled"
+	}
+	return "unknown"
+}
+
+// Result is what a ResultDoer reports about the task it performed.
+type Result struct {
+	Outcome Outcome
+	//For OutcomeThrottled, how long the server asked for no more requests to
+	// be made. Zero if it didn't say.
+	RetryAfter time.Duration
+	//Puts the task back at the head of its queue, to be performed again once
+	// its region allows. A task requeued by a Limiter which has been stopped
+	// is rejected instead.
+	Requeue bool
+}
+
+// ResultDoer is a LimitedDoer which reports how its task went. A Limiter
+// calls DoResult in place of Do for a ResultDoer. Tasks which are not
+// ResultDoers are taken to have OutcomeSucceeded.
+type ResultDoer interface {
+	LimitedDoer
+	DoResult() Result
+}
+
+// perform carries out a task, returning what it reports about how it went.
+func perform(task LimitedDoer) Result {
+	if rd, ok := task.(ResultDoer); ok {
+		return rd.DoResult()
+	}
+	task.Do()
+	return Result{Outcome: OutcomeSucceeded}
+}
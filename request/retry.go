@@ -0,0 +1,120 @@
+package request
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/thomasmmitchell/recentlyplayedplus/config"
+)
+
+// RetryPolicy decides which failed requests a Client sends again, and how long
+// it waits before each retry. Each retry is queued with the Limiter afresh, so
+// retries count against the rates of their region like any other request.
+type RetryPolicy struct {
+	//The most times a request is sent, including the first. 1 or less never
+	// retries.
+	MaxAttempts int
+	//How long to wait before the first retry. Doubles with each retry after
+	// that, up to MaxBackoff, if it is more than zero. A longer Retry-After
+	// from the API is waited for instead.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	//Up to this fraction of each wait is taken off it at random, so that
+	// requests which failed together aren't retried together
+	Jitter float64
+	//The HTTP statuses which are retried. Timeouts and broken connections are
+	// always retried. Requests turned away with a 429 are requeued by the Limiter
+	// regardless, up to their own limit.
+	Statuses []int
+}
+
+// DefaultRetryPolicy is what a Client uses unless configured otherwise.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	Backoff:     500 * time.Millisecond,
+	MaxBackoff:  10 * time.Second,
+	Jitter:      0.5,
+	Statuses:    []int{500, 502, 503, 504},
+}
+
+// NoRetries is a RetryPolicy which sends each request only once.
+var NoRetries = RetryPolicy{MaxAttempts: 1}
+
+// retryPolicyFrom makes a RetryPolicy from the retry settings of a
+// configuration, taking the settings left out from DefaultRetryPolicy.
+func retryPolicyFrom(cfg config.Retry) RetryPolicy {
+	ret := DefaultRetryPolicy
+	if cfg.MaxAttempts != 0 {
+		ret.MaxAttempts = cfg.MaxAttempts
+	}
+	if cfg.Backoff != 0 {
+		ret.Backoff = cfg.Backoff
+	}
+	if cfg.MaxBackoff != 0 {
+		ret.MaxBackoff = cfg.MaxBackoff
+	}
+	if cfg.Jitter != 0 {
+		ret.Jitter = cfg.Jitter
+	}
+	if len(cfg.Statuses) != 0 {
+		ret.Statuses = append([]int(nil), cfg.Statuses...)
+	}
+	return ret
+}
+
+// retryable is true if a request which failed with err, and whose caller is
+// still waiting on it, should be sent again.
+func (p RetryPolicy) retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		for _, status := range p.Statuses {
+			if apiErr.StatusCode == status {
+				return true
+			}
+		}
+		return false
+	}
+	//Only failures to reach the API or to hear back from it may go away.
+	// Others, such as too many redirects or a bad URL, would only recur.
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+// backoff is how long to wait before sending a request again, after the given
+// number of attempts failed, the last with err.
+func (p RetryPolicy) backoff(attempts int, err error) time.Duration {
+	wait := p.Backoff
+	for i := 1; i < attempts && (p.MaxBackoff <= 0 || wait < p.MaxBackoff); i++ {
+		if wait > math.MaxInt64/2 {
+			wait = math.MaxInt64
+			break
+		}
+		wait *= 2
+	}
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		wait -= time.Duration(p.Jitter * rand.Float64() * float64(wait))
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > wait {
+		wait = apiErr.RetryAfter
+	}
+	return wait
+}
@@ -0,0 +1,143 @@
+package request_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/thomasmmitchell/recentlyplayedplus/config"
+	. "github.com/thomasmmitchell/recentlyplayedplus/request"
+	"github.com/thomasmmitchell/recentlyplayedplus/request/fakeriot"
+	"github.com/thomasmmitchell/recentlyplayedplus/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Retries", func() {
+	api := withFakeAPI()
+
+	BeforeEach(func() {
+		api.cfg.Retry = config.Retry{
+			MaxAttempts: 3,
+			Backoff:     50 * time.Millisecond,
+		}
+	})
+
+	It("should retry transient failures until one succeeds", func() {
+		api.server.Inject(fakeriot.Fault{Status: http.StatusServiceUnavailable, Times: 2})
+		_, err := api.client.GetRecentGames("na", 42)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(api.server.Hits()).Should(HaveLen(3))
+	})
+
+	It("should give up after the most attempts, with the last error", func() {
+		api.server.Fail(5)
+		_, err := api.client.GetRecentGames("na", 42)
+		var apiErr *APIError
+		Ω(errors.As(err, &apiErr)).Should(BeTrue())
+		Ω(apiErr.StatusCode).Should(Equal(http.StatusInternalServerError))
+		Ω(api.server.Hits()).Should(HaveLen(3))
+	})
+
+	It("should not retry statuses which won't change", func() {
+		api.server.Inject(fakeriot.Fault{Status: http.StatusNotFound})
+		_, err := api.client.GetRecentGames("na", 42)
+		Ω(errors.Is(err, ErrNotFound)).Should(BeTrue())
+		Ω(api.server.Hits()).Should(HaveLen(1))
+	})
+
+	It("should retry connections which fail", func() {
+		var failed int32
+		api.client.SetHTTPClient(&http.Client{
+			Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				if atomic.AddInt32(&failed, 1) == 1 {
+					return nil, &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+				}
+				return http.DefaultTransport.RoundTrip(r)
+			}),
+		})
+		_, err := api.client.GetRecentGames("na", 42)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(api.server.Hits()).Should(HaveLen(1))
+	})
+
+	It("should not retry requests which would fail the same way again", func() {
+		api.client.SetHTTPClient(&http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return errors.New("stopped after too many redirects")
+			},
+		})
+		api.server.Redirect(api.server.BaseURL() + "/api/lol/na/v1.3/game/by-summoner/42")
+		_, err := api.client.GetRecentGames("na", 42)
+		Ω(err).Should(MatchError(ContainSubstring("stopped after too many redirects")))
+		Ω(api.server.Hits()).Should(HaveLen(1))
+	})
+
+	It("should back off exponentially between attempts", func() {
+		api.server.Fail(2)
+		_, err := api.client.GetRecentGames("na", 42)
+		Ω(err).ShouldNot(HaveOccurred())
+		hits := api.server.Hits()
+		Ω(hits).Should(HaveLen(3))
+		//The default jitter takes up to half of each wait off
+		Ω(hits[1].At.Sub(hits[0].At)).Should(BeNumerically(">=", 25*time.Millisecond))
+		Ω(hits[2].At.Sub(hits[1].At)).Should(BeNumerically(">=", 50*time.Millisecond))
+	})
+
+	It("should not overflow backing off without a cap", func() {
+		policy := RetryPolicy{MaxAttempts: 100, Backoff: time.Second}
+		Ω(BackoffFor(policy, 100, nil)).Should(BeNumerically(">=", 24*time.Hour))
+	})
+
+	It("should wait as long as the API asks", func() {
+		api.server.Inject(fakeriot.Fault{Status: http.StatusServiceUnavailable, RetryAfter: time.Second})
+		_, err := api.client.GetRecentGames("na", 42)
+		Ω(err).ShouldNot(HaveOccurred())
+		hits := api.server.Hits()
+		Ω(hits).Should(HaveLen(2))
+		Ω(hits[1].At.Sub(hits[0].At)).Should(BeNumerically(">=", time.Second))
+	})
+
+	It("should stop retrying once the caller gives up", func() {
+		api.server.Fail(5)
+		api.cfg.Retry.Backoff = time.Minute
+		api.client.Reconfigure(api.cfg)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err := api.client.GetRecentGamesContext(ctx, "na", 42)
+		Ω(err).Should(Equal(context.DeadlineExceeded))
+		Ω(api.server.Hits()).Should(HaveLen(1))
+	})
+
+	It("should use the policy set on the client over the configuration's", func() {
+		api.server.Fail(5)
+		api.client.SetRetryPolicy(&RetryPolicy{MaxAttempts: 2, Statuses: []int{http.StatusInternalServerError}})
+		_, err := api.client.GetRecentGames("na", 42)
+		Ω(err).Should(HaveOccurred())
+		Ω(api.server.Hits()).Should(HaveLen(2))
+	})
+
+	Context("When the region is rate limited", func() {
+		rate := types.Rate{Period: 1, Max: 2}
+
+		BeforeEach(func() {
+			api.cfg.Rates = []types.Rate{rate}
+			api.cfg.Retry.Backoff = 10 * time.Millisecond
+		})
+
+		It("should count retries against the region's rates", func() {
+			api.server.Fail(2)
+			start := time.Now()
+			_, err := api.client.GetRecentGames("na", 42)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(api.server.Hits()).Should(HaveLen(3))
+			Ω(api.server.WithinRate(rate)).Should(BeTrue())
+			Ω(time.Since(start)).Should(BeNumerically(">=", time.Second), "The third attempt should wait for allowance")
+		})
+	})
+})
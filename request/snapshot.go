@@ -0,0 +1,179 @@
+package request
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// snapshot is the form in which a MemoryStore is written out.
+type snapshot struct {
+	//When the snapshot was taken
+	SavedAt time.Time     `json:"saved_at"`
+	Logs    []snapshotLog `json:"logs"`
+}
+
+type snapshotLog struct {
+	Key    string `json:"key"`
+	Period uint32 `json:"period"`
+	//When each request counted against the limit was made, oldest first
+	Made []time.Time `json:"made"`
+}
+
+// WriteSnapshot writes the requests counted by this store, as of now, to w.
+// Requests which haven't completed are written as having been made when they
+// were reserved.
+func (s *MemoryStore) WriteSnapshot(w io.Writer, now time.Time) error {
+	s.lock.Lock()
+	snap := snapshot{SavedAt: now}
+	for key, log := range s.logs {
+		log.expire(key.period, now)
+		if len(log.entries) == 0 {
+			continue
+		}
+		made := make([]time.Time, 0, len(log.entries))
+		for _, entry := range log.entries {
+			made = append(made, entry.at)
+		}
+		snap.Logs = append(snap.Logs, snapshotLog{
+			Key:    key.key,
+			Period: key.period,
+			Made:   made,
+		})
+	}
+	s.lock.Unlock()
+	return json.NewEncoder(w).Encode(&snap)
+}
+
+// ReadSnapshot adds the requests in a snapshot written by WriteSnapshot to
+// those counted by this store. Requests are still counted from when they were
+// made, so any made more than a period before now don't count at all.
+// Requests which appear to have been made after now, such as when the system
+// clock has been turned back since, are counted as having been made now.
+func (s *MemoryStore) ReadSnapshot(r io.Reader, now time.Time) error {
+	var snap snapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return fmt.Errorf("Could not read snapshot: %s", err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, sl := range snap.Logs {
+		log := s.log(Limit{Key: sl.Key, Period: sl.Period})
+		for _, made := range sl.Made {
+			if made.After(now) {
+				made = now
+			}
+			log.entries = append(log.entries, usage{at: made})
+		}
+		//Restored requests may predate those already counted
+		sort.SliceStable(log.entries, func(i, j int) bool {
+			return log.entries[i].at.Before(log.entries[j].at)
+		})
+		log.expire(sl.Period, now)
+	}
+	return nil
+}
+
+// SaveFile writes a snapshot of this store to the file at path, replacing it
+// only once the snapshot has been written in full.
+func (s *MemoryStore) SaveFile(path string, now time.Time) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = s.WriteSnapshot(tmp, now); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadFile reads a snapshot from the file at path with ReadSnapshot. It is not
+// an error for the file not to exist, in which case nothing is read.
+func (s *MemoryStore) LoadFile(path string, now time.Time) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return s.ReadSnapshot(file, now)
+}
+
+// PersistTo keeps the requests counted against this Limiter's rates in the
+// file at path, so that a Limiter which restarts mid-period doesn't believe
+// their full allowance is available. Whatever the file already holds is
+// restored straight away. From then on a snapshot is saved every interval,
+// if interval isn't zero, and once more when the Limiter is stopped. Errs if
+// the file can't be read, if the Limiter's RateStore isn't a MemoryStore, or
+// if the Limiter has been stopped.
+func (l *Limiter) PersistTo(path string, interval time.Duration) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.isStopping {
+		return ErrLimiterStopped
+	}
+	store, ok := l.store.(*MemoryStore)
+	if !ok {
+		return fmt.Errorf("Cannot persist a RateStore of type %T", l.store)
+	}
+	if err := store.LoadFile(path, l.clock.Now()); err != nil {
+		return fmt.Errorf("Could not restore from '%s': %s", path, err)
+	}
+	l.snapshotPath = path
+	l.snapshotEvery = interval
+	l.scheduleSnapshot()
+	l.update()
+	return nil
+}
+
+// scheduleSnapshot sets the snapshot timer for the next periodic snapshot.
+// Must be called with the lock held.
+func (l *Limiter) scheduleSnapshot() {
+	if l.snapshotTimer != nil {
+		l.snapshotTimer.Stop()
+		l.snapshotTimer = nil
+	}
+	if l.snapshotEvery > 0 && !l.isStopped {
+		l.snapshotTimer = l.clock.AfterFunc(l.snapshotEvery, l.periodicSnapshot)
+	}
+}
+
+// periodicSnapshot is called by the snapshot timer. A snapshot which fails to
+// save is tried again at the next interval.
+func (l *Limiter) periodicSnapshot() {
+	l.lock.Lock()
+	path := l.snapshotPath
+	l.lock.Unlock()
+	l.store.(*MemoryStore).SaveFile(path, l.clock.Now())
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.scheduleSnapshot()
+}
+
+// finalSnapshot saves a snapshot as the Limiter stops, if it is persisted.
+// Must be called without the lock held, once the Limiter is stopped.
+func (l *Limiter) finalSnapshot() error {
+	l.lock.Lock()
+	path := l.snapshotPath
+	if l.snapshotTimer != nil {
+		l.snapshotTimer.Stop()
+		l.snapshotTimer = nil
+	}
+	l.lock.Unlock()
+	if path == "" {
+		return nil
+	}
+	return l.store.(*MemoryStore).SaveFile(path, l.clock.Now())
+}
@@ -0,0 +1,246 @@
+package request
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateStore keeps count of the requests made against the rates of a Limiter.
+// Limiters which share a RateStore share one budget for every rate with the
+// same key and period, which lets several processes using the same API key
+// stay within its limits together. Implementations must be safe for
+// concurrent use.
+type RateStore interface {
+	// Reserve counts one request against every given limit, as having been
+	// made now, provided each of them has allowance left. Either all limits
+	// are counted against or none are.
+	Reserve(limits []Limit, now time.Time) (Reservation, error)
+	// Complete moves the request counted by a reservation of the given limits
+	// to now, so that its allowance returns one period after it completed
+	// rather than one period after it was reserved.
+	Complete(limits []Limit, token string, now time.Time) error
+	// Release takes back the request counted by a reservation of the given
+	// limits, for a request which was never made, returning its allowance
+	// straight away.
+	Release(limits []Limit, token string) error
+	// Observe brings the number of requests counted against the limit within
+	// its period up to count, treating any requests it didn't know about as
+	// having been made now. Has no effect if at least that many are counted.
+	Observe(limit Limit, count uint32, now time.Time) error
+	// Seed counts against the limit to the requests counted against the limit
+	// from which were made within to's period, for a rate added alongside
+	// another which already has a history. Has no effect if to already counts
+	// at least as many requests.
+	Seed(to, from Limit, now time.Time) error
+	// Remaining reports the allowance left in each of the given limits, in
+	// the same order, without counting anything against them.
+	Remaining(limits []Limit, now time.Time) ([]uint32, error)
+}
+
+// Limit identifies a rate to a RateStore. Requests are counted separately for
+// each Key and Period.
+type Limit struct {
+	Key string
+	//Number of seconds within which Max requests can occur. Requests counted
+	// against a period of zero never stop counting.
+	Period uint32
+	Max    uint32
+}
+
+// Reservation is the outcome of RateStore.Reserve.
+type Reservation struct {
+	//True if the request was counted against every limit
+	OK bool
+	//Identifies the request to Complete
+	Token string
+	//The least allowance left among the limits, before this request
+	Remaining uint32
+	//When not OK, the earliest time at which every limit may have allowance.
+	// Zero if it will never happen.
+	RetryAt time.Time
+}
+
+// MemoryStore is a RateStore which keeps its counts in the memory of this
+// process. It is what Limiters use unless given another RateStore.
+type MemoryStore struct {
+	logs map[logKey]*usageLog
+	//Used to make each reservation's token unique
+	reserved uint64
+	lock     sync.Mutex
+}
+
+type logKey struct {
+	key    string
+	period uint32
+}
+
+// usageLog holds the requests counted against a limit within its period,
+// oldest first.
+type usageLog struct {
+	entries []usage
+}
+
+type usage struct {
+	token string
+	at    time.Time
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		logs: make(map[logKey]*usageLog),
+	}
+}
+
+// Reserve implements RateStore.
+func (s *MemoryStore) Reserve(limits []Limit, now time.Time) (Reservation, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := Reservation{Remaining: math.MaxUint32}
+	blocked, neverFree := false, false
+	for _, limit := range limits {
+		log := s.log(limit)
+		log.expire(limit.Period, now)
+		used := uint32(len(log.entries))
+		if used < limit.Max {
+			if left := limit.Max - used; left < res.Remaining {
+				res.Remaining = left
+			}
+			continue
+		}
+		res.Remaining = 0
+		blocked = true
+		if limit.Period == 0 {
+			neverFree = true
+			continue
+		}
+		//This many entries need to expire to get under the max
+		at := log.entries[used-limit.Max].at.Add(window(limit.Period))
+		if at.After(res.RetryAt) {
+			res.RetryAt = at
+		}
+	}
+	if blocked {
+		if neverFree {
+			res.RetryAt = time.Time{}
+		}
+		return res, nil
+	}
+	s.reserved++
+	res.OK = true
+	res.Token = strconv.FormatUint(s.reserved, 10)
+	for _, limit := range limits {
+		log := s.log(limit)
+		log.entries = append(log.entries, usage{token: res.Token, at: now})
+	}
+	return res, nil
+}
+
+// Complete implements RateStore.
+func (s *MemoryStore) Complete(limits []Limit, token string, now time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, limit := range limits {
+		log := s.log(limit)
+		for i, entry := range log.entries {
+			if entry.token == token {
+				log.entries = append(log.entries[:i], log.entries[i+1:]...)
+				log.entries = append(log.entries, usage{token: token, at: now})
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Release implements RateStore.
+func (s *MemoryStore) Release(limits []Limit, token string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, limit := range limits {
+		log := s.log(limit)
+		for i, entry := range log.entries {
+			if entry.token == token {
+				log.entries = append(log.entries[:i], log.entries[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Observe implements RateStore.
+func (s *MemoryStore) Observe(limit Limit, count uint32, now time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	log := s.log(limit)
+	log.expire(limit.Period, now)
+	for used := uint32(len(log.entries)); used < count; used++ {
+		log.entries = append(log.entries, usage{at: now})
+	}
+	return nil
+}
+
+// Seed implements RateStore.
+func (s *MemoryStore) Seed(to, from Limit, now time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	toLog, fromLog := s.log(to), s.log(from)
+	toLog.expire(to.Period, now)
+	fromLog.expire(from.Period, now)
+	entries := fromLog.entries
+	if to.Period != 0 {
+		cutoff := now.Add(-window(to.Period))
+		for len(entries) > 0 && !entries[0].at.After(cutoff) {
+			entries = entries[1:]
+		}
+	}
+	if len(entries) > len(toLog.entries) {
+		toLog.entries = append([]usage(nil), entries...)
+	}
+	return nil
+}
+
+// Remaining implements RateStore.
+func (s *MemoryStore) Remaining(limits []Limit, now time.Time) ([]uint32, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ret := make([]uint32, len(limits))
+	for i, limit := range limits {
+		log := s.log(limit)
+		log.expire(limit.Period, now)
+		if used := uint32(len(log.entries)); used < limit.Max {
+			ret[i] = limit.Max - used
+		}
+	}
+	return ret, nil
+}
+
+func (s *MemoryStore) log(limit Limit) *usageLog {
+	key := logKey{key: limit.Key, period: limit.Period}
+	log, ok := s.logs[key]
+	if !ok {
+		log = &usageLog{}
+		s.logs[key] = log
+	}
+	return log
+}
+
+// expire drops the entries of the log which no longer count towards the max.
+func (l *usageLog) expire(period uint32, now time.Time) {
+	if period == 0 {
+		return
+	}
+	cutoff := now.Add(-window(period))
+	expired := 0
+	for expired < len(l.entries) && !l.entries[expired].at.After(cutoff) {
+		expired++
+	}
+	l.entries = l.entries[expired:]
+}
+
+func window(period uint32) time.Duration {
+	return time.Duration(period) * time.Second
+}
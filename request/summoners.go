@@ -0,0 +1,144 @@
+package request
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/thomasmmitchell/recentlyplayedplus/types"
+)
+
+// maxSummonerNames is the most names the API looks up in one request.
+const maxSummonerNames = 40
+
+// NormalizeName returns the form of a summoner name which the API keys the
+// summoners it finds by, lower case with spaces removed.
+func NormalizeName(name string) string {
+	return strings.ToLower(strings.Replace(name, " ", "", -1))
+}
+
+// GetSummoners looks up the summoners with the given names in region. The
+// summoners found are keyed by their name as given by NormalizeName, and the
+// names which no summoner has are returned as they were given. Names are
+// looked up up to 40 at a time, the most the API takes in one request. If any
+// of those requests fails, the rest are given up on and its error is returned.
+// Summoners in the Client's cache are returned without being looked up.
+func (c *Client) GetSummoners(region string, names ...string) (map[string]types.Summoner, []string, error) {
+	return c.GetSummonersContext(context.Background(), region, names...)
+}
+
+// GetSummonersContext is GetSummoners, but gives up once ctx is done. If a
+// request is still waiting on the Limiter at that point, it is withdrawn from
+// the queue without ever being sent. Returns ctx.Err() when giving up.
+func (c *Client) GetSummonersContext(ctx context.Context, region string, names ...string) (map[string]types.Summoner, []string, error) {
+	var unique []string
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		normalized := NormalizeName(name)
+		if normalized != "" && !seen[normalized] {
+			seen[normalized] = true
+			unique = append(unique, normalized)
+		}
+	}
+	found := make(map[string]types.Summoner, len(unique))
+	cache, ttls := c.cached()
+	if cache != nil {
+		missing := unique[:0]
+		for _, name := range unique {
+			var summoner types.Summoner
+			if value, ok := cache.Get(summonerKey(region, name)); ok && json.Unmarshal(value, &summoner) == nil {
+				found[name] = summoner
+			} else {
+				missing = append(missing, name)
+			}
+		}
+		unique = missing
+	}
+	//The other chunks are of no use once one fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var firstErr error
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for start := 0; start < len(unique); start += maxSummonerNames {
+		end := start + maxSummonerNames
+		if end > len(unique) {
+			end = len(unique)
+		}
+		wg.Add(1)
+		go func(chunk []string) {
+			defer wg.Done()
+			summoners, err := c.getSummonerChunk(ctx, region, chunk)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				return
+			}
+			for name, summoner := range summoners {
+				found[name] = summoner
+				if cache != nil {
+					//The summoner is still good without being cached
+					if value, err := json.Marshal(summoner); err == nil {
+						cache.Set(summonerKey(region, name), value, ttls.Summoner)
+					}
+				}
+			}
+		}(unique[start:end])
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, nil, firstErr
+	}
+	var notFound []string
+	reported := make(map[string]bool)
+	for _, name := range names {
+		normalized := NormalizeName(name)
+		if _, ok := found[normalized]; !ok && !reported[normalized] {
+			reported[normalized] = true
+			notFound = append(notFound, name)
+		}
+	}
+	return found, notFound, nil
+}
+
+// getSummonerChunk looks up no more than maxSummonerNames summoners in one
+// request. The API answers with a 404 when it finds none of them, which is
+// taken as an empty result.
+func (c *Client) getSummonerChunk(ctx context.Context, region string, names []string) (map[string]types.Summoner, error) {
+	escaped := make([]string, len(names))
+	for i, name := range names {
+		escaped[i] = url.PathEscape(name)
+	}
+	endpoint := fmt.Sprintf("/api/lol/%s/v1.4/summoner/by-name/%s", region, strings.Join(escaped, ","))
+	response, err := c.fetch(ctx, region, MethodSummoner, endpoint)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	//The API keys the summoners it finds by their normalised name
+	ret := make(map[string]types.Summoner)
+	if err = json.Unmarshal(response, &ret); err != nil {
+		return nil, fmt.Errorf("Could not read summoners: %s", err)
+	}
+	for name, summoner := range ret {
+		summoner.Region = region
+		ret[name] = summoner
+	}
+	return ret, nil
+}
+
+// summonerKey is the key a summoner is cached under, given their normalised
+// name.
+func summonerKey(region, name string) string {
+	return fmt.Sprintf("summoner/%s/%s", region, name)
+}
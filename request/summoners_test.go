@@ -0,0 +1,107 @@
+package request_test
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/thomasmmitchell/recentlyplayedplus/request"
+	"github.com/thomasmmitchell/recentlyplayedplus/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Summoner lookups", func() {
+	api := withFakeAPI()
+
+	It("should normalise names", func() {
+		Ω(NormalizeName("Some One")).Should(Equal("someone"))
+		Ω(NormalizeName(" SOME ONE ")).Should(Equal("someone"))
+	})
+
+	It("should return every summoner found, and the names which weren't", func() {
+		api.server.AddSummoner("na", types.Summoner{Name: "First One", ID: 1})
+		api.server.AddSummoner("na", types.Summoner{Name: "Second", ID: 2})
+		summoners, notFound, err := api.client.GetSummoners("na", "First One", "nobody", "SECOND")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(summoners).Should(Equal(map[string]types.Summoner{
+			"firstone": {Name: "First One", ID: 1, Region: "na"},
+			"second":   {Name: "Second", ID: 2, Region: "na"},
+		}))
+		Ω(notFound).Should(Equal([]string{"nobody"}))
+		Ω(api.server.Hits()).Should(HaveLen(1), "The names should be looked up in one request")
+	})
+
+	It("should split more names than the API takes at once across requests", func() {
+		var names []string
+		for i := 0; i < 90; i++ {
+			name := fmt.Sprintf("summoner%d", i)
+			names = append(names, name)
+			if i%2 == 0 {
+				api.server.AddSummoner("na", types.Summoner{Name: name, ID: uint64(i + 1)})
+			}
+		}
+		summoners, notFound, err := api.client.GetSummoners("na", names...)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(summoners).Should(HaveLen(45))
+		Ω(notFound).Should(HaveLen(45))
+		Ω(summoners["summoner88"].ID).Should(BeEquivalentTo(89))
+		Ω(notFound).Should(ContainElement("summoner89"))
+		Ω(api.server.Hits()).Should(HaveLen(3))
+	})
+
+	It("should look up each name only once", func() {
+		api.server.AddSummoner("na", types.Summoner{Name: "Some One", ID: 1})
+		summoners, notFound, err := api.client.GetSummoners("na", "Some One", "someone", "nobody", "NOBODY")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(summoners).Should(HaveLen(1))
+		Ω(notFound).Should(Equal([]string{"nobody"}))
+		Ω(api.server.Hits()[0].Path).Should(HaveSuffix("/by-name/someone,nobody"))
+	})
+
+	It("should escape names in the URL", func() {
+		api.server.AddSummoner("na", types.Summoner{Name: "a/b?c#d", ID: 1})
+		summoners, notFound, err := api.client.GetSummoners("na", "a/b?c#d", "Ünïcode")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(summoners).Should(HaveKey("a/b?c#d"))
+		Ω(notFound).Should(Equal([]string{"Ünïcode"}))
+	})
+
+	It("should fail if any request fails", func() {
+		api.client.SetRetryPolicy(&NoRetries)
+		api.server.Fail(1)
+		_, _, err := api.client.GetSummoners("na", "someone")
+		Ω(err).Should(MatchError(ContainSubstring("500")))
+	})
+
+	It("should give up on the other requests once one fails", func() {
+		api.cfg.Rates = []types.Rate{{Period: 10, Max: 1}}
+		api.client.Reconfigure(api.cfg)
+		api.client.SetRetryPolicy(&NoRetries)
+		api.server.Fail(1)
+		var names []string
+		for i := 0; i < 80; i++ {
+			names = append(names, fmt.Sprintf("summoner%d", i))
+		}
+		start := time.Now()
+		_, _, err := api.client.GetSummoners("na", names...)
+		Ω(err).Should(MatchError(ContainSubstring("500")))
+		Ω(time.Since(start)).Should(BeNumerically("<", 5*time.Second), "Should not wait for the rates to allow the other request")
+		Ω(api.server.Hits()).Should(HaveLen(1))
+	})
+
+	It("should find nobody when the API finds none of the names", func() {
+		summoners, notFound, err := api.client.GetSummoners("na", "nobody", "Someone Else")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(summoners).Should(BeEmpty())
+		Ω(notFound).Should(Equal([]string{"nobody", "Someone Else"}))
+	})
+
+	It("should not make a request without names", func() {
+		summoners, notFound, err := api.client.GetSummoners("na")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(summoners).Should(BeEmpty())
+		Ω(notFound).Should(BeEmpty())
+		Ω(api.server.Hits()).Should(BeEmpty())
+	})
+})
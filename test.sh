@@ -12,5 +12,20 @@ $spruceAPI "${templates}/onereg.yml" \
            "${templates}/manyrates.yml"   > "${output}/oneregmanyrates.yml" 
 $spruceAPI "${templates}/manyregs.yml" \
            "${templates}/onerate.yml"     > "${output}/manyregsonerate.yml" 
+$spruceAPI "${templates}/onereg.yml" \
+           "${templates}/onerate.yml" \
+           "${templates}/methods.yml"     > "${output}/oneregmethods.yml" 
+$spruceAPI "${templates}/onereg.yml" \
+           "${templates}/onerate.yml" \
+           "${templates}/inflight.yml"    > "${output}/onereginflight.yml" 
+$spruceAPI "${templates}/onereg.yml" \
+           "${templates}/onerate.yml" \
+           "${templates}/http.yml"        > "${output}/onereghttp.yml" 
+$spruceAPI "${templates}/onereg.yml" \
+           "${templates}/onerate.yml" \
+           "${templates}/retry.yml"       > "${output}/oneregretry.yml" 
+$spruceAPI "${templates}/onereg.yml" \
+           "${templates}/onerate.yml" \
+           "${templates}/cache.yml"       > "${output}/oneregcache.yml" 
 
-ginkgo -noColor -slowSpecThreshold 8 * 
+ginkgo -noColor -r